@@ -0,0 +1,119 @@
+package aggregate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of the CSV, JSONL and Docker stats output. Appending to an
+// existing file starts a new gzip member or zstd frame, both of which are read
+// as one stream.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var compressionExts = map[string]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// compressor flushes compressed data without ending the stream.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressor(w io.Writer, compression string) (compressor, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// Many files are open at once, keep the encoders small.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+	}
+	return nil, nil
+}
+
+// compressionOf returns the compression of a file by its extension.
+func compressionOf(path string) string {
+	for compression, ext := range compressionExts {
+		if ext != "" && strings.HasSuffix(path, ext) {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+// openDecompressed opens a file for reading, decompressing it if needed.
+func openDecompressed(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.ReadCloser
+	switch compressionOf(path) {
+	case CompressionGzip:
+		reader, err = gzip.NewReader(file)
+	case CompressionZstd:
+		var decoder *zstd.Decoder
+		if decoder, err = zstd.NewReader(file); err == nil {
+			reader = decoder.IOReadCloser()
+		}
+	default:
+		return file, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, closers{reader, file}}, nil
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, closer := range c {
+		if e := closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Rotated files are named <name>.<rotation time>[-<n>].<ext>[.gz|.zst].
+const rotationTimeLayout = "20060102T150405Z"
+
+var rotatedFilePattern = regexp.MustCompile(`\.\d{8}T\d{6}Z(-\d+)?\.[^.]+(\.gz|\.zst)?$`)
+
+// IsRotatedFile reports whether the file is a rotated, no longer written file.
+func IsRotatedFile(path string) bool {
+	return rotatedFilePattern.MatchString(filepath.Base(path))
+}
+
+// rotatedPath returns a free name for the file of the logical path rotated at t.
+func rotatedPath(path, compressionExt string, t time.Time) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext) + "." + t.UTC().Format(rotationTimeLayout)
+	rotated := stem + ext + compressionExt
+	for n := 1; ; n++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			return rotated
+		}
+		rotated = fmt.Sprintf("%s-%d%s%s", stem, n, ext, compressionExt)
+	}
+}
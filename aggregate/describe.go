@@ -0,0 +1,136 @@
+package aggregate
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// FileDescription summarises a result file for the run manifest.
+type FileDescription struct {
+	Path   string   `json:"path"`
+	Size   int64    `json:"size"`
+	Rows   int64    `json:"rows"`             // Data rows, without the CSV header.
+	Schema []string `json:"schema,omitempty"` // Columns, or tables of a database.
+}
+
+// DescribeFile counts the rows of a result file and reads its columns.
+// Files of unknown type are only described by their size.
+func DescribeFile(path string) (FileDescription, error) {
+	description := FileDescription{Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return description, err
+	}
+	description.Size = info.Size()
+
+	switch filepath.Ext(strings.TrimSuffix(path, compressionExts[compressionOf(path)])) {
+	case ".csv":
+		err = describeCSV(path, &description)
+	case ".jsonl", ".json":
+		err = describeLines(path, &description)
+	case ".parquet":
+		err = describeParquet(path, &description)
+	case ".db":
+		err = describeSQLite(path, &description)
+	}
+	return description, err
+}
+
+func describeCSV(path string, description *FileDescription) error {
+	file, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	description.Schema = header
+	for {
+		if _, err := reader.Read(); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		description.Rows++
+	}
+}
+
+func describeLines(path string, description *FileDescription) error {
+	file, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		description.Rows += int64(bytes.Count(buffer[:n], []byte{'\n'}))
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func describeParquet(path string, description *FileDescription) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	parquetFile, err := parquet.OpenFile(file, description.Size)
+	if err != nil {
+		return err
+	}
+	description.Rows = parquetFile.NumRows()
+	for _, field := range parquetFile.Schema().Fields() {
+		description.Schema = append(description.Schema, field.Name())
+	}
+	return nil
+}
+
+// describeSQLite lists the tables and counts the samples of a results database.
+func describeSQLite(path string, description *FileDescription) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		description.Schema = append(description.Schema, table)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return db.QueryRow(`SELECT count(*) FROM samples`).Scan(&description.Rows)
+}
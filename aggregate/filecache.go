@@ -0,0 +1,472 @@
+package aggregate
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of the output file cache.
+const (
+	DefaultMaxOpenFiles  = 256
+	DefaultFlushInterval = 5 * time.Second
+	fileBufferSize       = 64 * 1024
+)
+
+// RotationOptions configure when output files are rotated. Zero values
+// disable the respective rotation.
+type RotationOptions struct {
+	MaxSize  int64         // Bytes on disk.
+	Interval time.Duration // Time since the file was started or, if reopened, last written.
+}
+
+// sizeWriter counts the bytes written to a file.
+type sizeWriter struct {
+	w    io.Writer
+	size *int64
+}
+
+func (s sizeWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	*s.size += int64(n)
+	bytesWritten.Add(int64(n))
+	return n, err
+}
+
+type cachedFile struct {
+	path       string // Logical path, without compression extension.
+	actualPath string
+	file       *os.File
+	size       int64
+	compressor compressor
+	buffer     *bufio.Writer
+	writer     *csv.Writer
+	header     []string
+	empty      bool // The header still has to be written.
+	dirty      bool // Data is buffered but not flushed.
+	element    *list.Element
+	started    time.Time // The age rotation counts from.
+}
+
+func (f *cachedFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return err
+	}
+	f.dirty = false
+	if err := f.buffer.Flush(); err != nil {
+		return err
+	}
+	if f.compressor != nil {
+		return f.compressor.Flush()
+	}
+	return nil
+}
+
+func (f *cachedFile) close() error {
+	errs := []error{f.flush()}
+	if f.compressor != nil {
+		errs = append(errs, f.compressor.Close())
+	}
+	return errors.Join(append(errs, f.file.Close())...)
+}
+
+// FileCache keeps the most recently written output files open with buffered,
+// optionally compressing writers. The least recently used file is flushed and
+// closed once more than maxOpen files are open. Files are rotated once they
+// exceed the configured size or age. It is safe for concurrent use.
+type FileCache struct {
+	mu          sync.Mutex
+	maxOpen     int
+	compression string
+	rotation    RotationOptions
+	files       map[string]*cachedFile
+	lru         *list.List // Most recently used first.
+}
+
+func NewFileCache(maxOpen int) *FileCache {
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenFiles
+	}
+	return &FileCache{
+		maxOpen:     maxOpen,
+		compression: CompressionNone,
+		files:       make(map[string]*cachedFile),
+		lru:         list.New(),
+	}
+}
+
+// SetMaxOpenFiles changes the number of files kept open, closing the least
+// recently used ones if needed.
+func (c *FileCache) SetMaxOpenFiles(maxOpen int) {
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenFiles
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxOpen = maxOpen
+	c.evict()
+}
+
+// SetCompression sets the compression of files opened from now on: none
+// (default), gzip or zstd.
+func (c *FileCache) SetCompression(compression string) error {
+	if compression == "" {
+		compression = CompressionNone
+	}
+	if _, ok := compressionExts[compression]; !ok {
+		return fmt.Errorf("unknown output compression %q", compression)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compression = compression
+	return nil
+}
+
+func (c *FileCache) SetRotation(rotation RotationOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotation = rotation
+}
+
+// WriteCSV appends records to the CSV file at path. The header is written
+// first if the file is new or empty. Records are reordered to match the
+// header of an existing file. When header brings new columns, the file is
+// rotated and a new one is started with the columns of both.
+func (c *FileCache) WriteCSV(path string, header []string, records ...[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeCSV(path, header, records)
+}
+
+// WriteVersionedCSV appends records like WriteCSV, but a file written with a
+// different header is moved aside to <name>.<unix time>.<ext> instead of
+// getting new columns, so a single file never mixes column layouts.
+func (c *FileCache) WriteVersionedCSV(path string, header []string, records ...[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := c.open(path)
+	if err != nil {
+		return err
+	}
+	if f.header != nil && !slices.Equal(f.header, header) {
+		if err := c.remove(f); err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		legacyPath := fmt.Sprintf("%s.%d%s%s", strings.TrimSuffix(path, ext), time.Now().Unix(), ext, compressionExts[compressionOf(f.actualPath)])
+		logrus.Warnf("Column schema of %s changed, moving old file to %s", f.actualPath, legacyPath)
+		if err := os.Rename(f.actualPath, legacyPath); err != nil {
+			return err
+		}
+	}
+	return c.writeCSV(path, header, records)
+}
+
+func (c *FileCache) writeCSV(path string, header []string, records [][]string) error {
+	f, err := c.open(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case header == nil:
+	case f.empty:
+		if err := f.writer.Write(header); err != nil {
+			c.remove(f)
+			return err
+		}
+		f.header = header
+		f.empty = false
+	case f.header != nil && !slices.Equal(f.header, header):
+		if f, err = c.evolve(f, header); err != nil {
+			return err
+		}
+		records = reorderColumns(records, header, f.header)
+	}
+	for _, record := range records {
+		if err := f.writer.Write(record); err != nil {
+			c.remove(f)
+			return err
+		}
+	}
+	f.dirty = true
+	return nil
+}
+
+// Write appends raw data to the file at path.
+func (c *FileCache) Write(path string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := c.open(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.buffer.Write(data); err != nil {
+		c.remove(f)
+		return err
+	}
+	f.empty = false
+	f.dirty = true
+	return nil
+}
+
+// open returns the open file of the path, rotating it first if it is due.
+func (c *FileCache) open(path string) (*cachedFile, error) {
+	if f, ok := c.files[path]; ok {
+		if !c.dueForRotation(f) {
+			c.lru.MoveToFront(f.element)
+			return f, nil
+		}
+		if err := c.rotate(f); err != nil {
+			return nil, err
+		}
+	}
+	return c.openFile(path)
+}
+
+// openFile opens the file of the path for appending. Files left over too
+// large or last written too long ago are rotated first.
+func (c *FileCache) openFile(path string) (*cachedFile, error) {
+	if _, err := CreateOutputFolder(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	actualPath := path + compressionExts[c.compression]
+	file, err := os.OpenFile(actualPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &cachedFile{
+		path:       path,
+		actualPath: actualPath,
+		file:       file,
+		size:       info.Size(),
+		empty:      info.Size() == 0,
+		started:    time.Now(),
+	}
+	if !f.empty {
+		// The creation time is not portable, the last write tells at least
+		// how long a leftover file lay around.
+		f.started = info.ModTime()
+	}
+	var out io.Writer = sizeWriter{file, &f.size}
+	if f.compressor, err = newCompressor(out, c.compression); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if f.compressor != nil {
+		out = f.compressor
+	}
+	f.buffer = bufio.NewWriterSize(out, fileBufferSize)
+	f.writer = csv.NewWriter(f.buffer)
+
+	if !f.empty && filepath.Ext(path) == ".csv" {
+		if f.header, err = readCSVHeader(actualPath); err != nil {
+			logrus.Warnf("Error reading header of %s: %v", actualPath, err)
+		}
+	}
+	f.element = c.lru.PushFront(f)
+	c.files[path] = f
+	if c.dueForRotation(f) {
+		if err := c.rotate(f); err != nil {
+			return nil, err
+		}
+		return c.openFile(path)
+	}
+	c.evict()
+	return f, nil
+}
+
+func (c *FileCache) dueForRotation(f *cachedFile) bool {
+	if f.empty {
+		return false
+	}
+	if c.rotation.MaxSize > 0 && f.size >= c.rotation.MaxSize {
+		return true
+	}
+	return c.rotation.Interval > 0 && time.Since(f.started) >= c.rotation.Interval
+}
+
+// rotate closes the file and moves it to its rotated name, so the next write
+// starts a new file with a header.
+func (c *FileCache) rotate(f *cachedFile) error {
+	if err := c.remove(f); err != nil {
+		return err
+	}
+	rotated := rotatedPath(f.path, compressionExts[compressionOf(f.actualPath)], time.Now())
+	logrus.Infof("Rotating %s to %s", f.actualPath, rotated)
+	return os.Rename(f.actualPath, rotated)
+}
+
+// evolve rolls the file over to its rotated name when header has columns the
+// file lacks. The new file starts with the file's columns followed by the
+// added ones, so the rows written so far are never rewritten.
+func (c *FileCache) evolve(f *cachedFile, header []string) (*cachedFile, error) {
+	var added []string
+	for _, column := range header {
+		if !slices.Contains(f.header, column) {
+			added = append(added, column)
+		}
+	}
+	if len(added) == 0 {
+		return f, nil
+	}
+	logrus.Infof("Columns %v are new to %s, continuing in a new file", added, f.actualPath)
+
+	widened := append(slices.Clip(f.header), added...)
+	if err := c.rotate(f); err != nil {
+		return nil, err
+	}
+	f, err := c.open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.writer.Write(widened); err != nil {
+		c.remove(f)
+		return nil, err
+	}
+	f.header = widened
+	f.empty = false
+	return f, nil
+}
+
+// reorderColumns moves the values of records written for header to the
+// positions of its columns in target.
+func reorderColumns(records [][]string, header, target []string) [][]string {
+	positions := make([]int, len(header))
+	for i, column := range header {
+		positions[i] = slices.Index(target, column)
+	}
+	reordered := make([][]string, 0, len(records))
+	for _, record := range records {
+		values := make([]string, len(target))
+		for i, value := range record {
+			if i < len(positions) && positions[i] >= 0 {
+				values[positions[i]] = value
+			}
+		}
+		reordered = append(reordered, values)
+	}
+	return reordered
+}
+
+func readCSVHeader(path string) ([]string, error) {
+	file, err := openDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := csv.NewReader(file).Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	return header, err
+}
+
+func (c *FileCache) evict() {
+	for c.lru.Len() > c.maxOpen {
+		f := c.lru.Back().Value.(*cachedFile)
+		if err := c.remove(f); err != nil {
+			logrus.Errorf("Error closing %s: %v", f.actualPath, err)
+		}
+	}
+}
+
+func (c *FileCache) remove(f *cachedFile) error {
+	c.lru.Remove(f.element)
+	delete(c.files, f.path)
+	return f.close()
+}
+
+// Flush writes the buffered data of all open files.
+func (c *FileCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, f := range c.files {
+		errs = append(errs, f.flush())
+	}
+	return errors.Join(errs...)
+}
+
+// CloseFile flushes and closes the file at path if it is open, so it can be
+// moved or rewritten.
+func (c *FileCache) CloseFile(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.files[path]; ok {
+		return c.remove(f)
+	}
+	return nil
+}
+
+// Close flushes and closes all open files. Later writes open them again.
+func (c *FileCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, f := range c.files {
+		errs = append(errs, c.remove(f))
+	}
+	return errors.Join(errs...)
+}
+
+// FlushPeriodically flushes the open files every interval until the context
+// is cancelled.
+func (c *FileCache) FlushPeriodically(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Flush(); err != nil {
+				logrus.Error("Error flushing output files: ", err)
+			}
+		}
+	}
+}
+
+// OutputFiles is the cache all CSV, JSONL and Docker stats output is written
+// through.
+var OutputFiles = NewFileCache(DefaultMaxOpenFiles)
+
+// WriteCSV appends records to a CSV output file through OutputFiles.
+func WriteCSV(path string, header []string, records ...[]string) error {
+	return OutputFiles.WriteCSV(path, header, records...)
+}
+
+// WriteVersionedCSV appends records to a CSV output file through OutputFiles,
+// moving a file with a different header aside.
+func WriteVersionedCSV(path string, header []string, records ...[]string) error {
+	return OutputFiles.WriteVersionedCSV(path, header, records...)
+}
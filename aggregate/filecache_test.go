@@ -0,0 +1,331 @@
+package aggregate
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var compressions = []string{CompressionNone, CompressionGzip, CompressionZstd}
+
+// readCSV reads all rows of a possibly compressed CSV file.
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	file, err := openDecompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestFileCacheBuffersUntilFlush(t *testing.T) {
+	cache := NewFileCache(0)
+	defer cache.Close()
+	path := filepath.Join(t.TempDir(), "metric.csv")
+	if err := cache.WriteCSV(path, []string{"value"}, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("got %q before the flush, want nothing", data)
+	}
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "value\n1\n" {
+		t.Errorf("got %q after the flush, want the header and the record", data)
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewFileCache(2)
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.csv", "b.csv", "c.csv"} {
+		path := filepath.Join(dir, name)
+		paths = append(paths, path)
+		if err := cache.WriteCSV(path, []string{"value"}, []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := cache.files[paths[0]]; ok || len(cache.files) != 2 {
+		t.Errorf("got %d open files including the least recently used one, want 2 without it", len(cache.files))
+	}
+	// The evicted file was flushed and is appended to without another header.
+	if data, _ := os.ReadFile(paths[0]); string(data) != "value\n1\n" {
+		t.Errorf("got %q in the evicted file, want the header and the record", data)
+	}
+	if err := cache.WriteCSV(paths[0], []string{"value"}, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(paths[0]); string(data) != "value\n1\n2\n" {
+		t.Errorf("got %q after reopening, want both records under one header", data)
+	}
+}
+
+func TestReorderColumns(t *testing.T) {
+	tests := []struct {
+		name           string
+		header, target []string
+		record, want   []string
+	}{
+		{"same order", []string{"a", "b"}, []string{"a", "b"}, []string{"1", "2"}, []string{"1", "2"}},
+		{"swapped", []string{"b", "a"}, []string{"a", "b"}, []string{"2", "1"}, []string{"1", "2"}},
+		{"missing column", []string{"a", "c"}, []string{"a", "b", "c"}, []string{"1", "3"}, []string{"1", "", "3"}},
+		{"unknown column", []string{"a", "x"}, []string{"a"}, []string{"1", "9"}, []string{"1"}},
+		{"short record", []string{"a", "b"}, []string{"b", "a"}, []string{"1"}, []string{"", "1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := reorderColumns([][]string{test.record}, test.header, test.target)
+			if !reflect.DeepEqual(got, [][]string{test.want}) {
+				t.Errorf("got %v, want %v", got, [][]string{test.want})
+			}
+		})
+	}
+}
+
+func TestWriteCSVEvolvesHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers [][]string
+		records [][]string
+		want    [][]string
+		rolled  [][]string // Rows of the rotated file, nil if none.
+	}{
+		{
+			"same columns in another order",
+			[][]string{{"a", "b"}, {"b", "a"}},
+			[][]string{{"1", "2"}, {"4", "3"}},
+			[][]string{{"a", "b"}, {"1", "2"}, {"3", "4"}},
+			nil,
+		},
+		{
+			"column appended",
+			[][]string{{"a", "b"}, {"a", "b", "c"}},
+			[][]string{{"1", "2"}, {"3", "4", "5"}},
+			[][]string{{"a", "b", "c"}, {"3", "4", "5"}},
+			[][]string{{"a", "b"}, {"1", "2"}},
+		},
+		{
+			"column added in front",
+			[][]string{{"a", "b"}, {"c", "a", "b"}},
+			[][]string{{"1", "2"}, {"5", "3", "4"}},
+			[][]string{{"a", "b", "c"}, {"3", "4", "5"}},
+			[][]string{{"a", "b"}, {"1", "2"}},
+		},
+		{
+			"column left out",
+			[][]string{{"a", "b", "c"}, {"a", "c"}},
+			[][]string{{"1", "2", "3"}, {"4", "6"}},
+			[][]string{{"a", "b", "c"}, {"1", "2", "3"}, {"4", "", "6"}},
+			nil,
+		},
+		{
+			"column replaced",
+			[][]string{{"a", "b"}, {"a", "c"}},
+			[][]string{{"1", "2"}, {"3", "4"}},
+			[][]string{{"a", "b", "c"}, {"3", "", "4"}},
+			[][]string{{"a", "b"}, {"1", "2"}},
+		},
+	}
+	for _, compression := range compressions {
+		for _, test := range tests {
+			t.Run(compression+"/"+test.name, func(t *testing.T) {
+				cache := NewFileCache(0)
+				cache.SetCompression(compression)
+				dir := t.TempDir()
+				path := filepath.Join(dir, "metric.csv")
+				for i, header := range test.headers {
+					if err := cache.WriteCSV(path, header, test.records[i]); err != nil {
+						t.Fatal(err)
+					}
+					// Reopening has to read the header back from the file.
+					if err := cache.CloseFile(path); err != nil {
+						t.Fatal(err)
+					}
+				}
+				ext := compressionExts[compression]
+				if got := readCSV(t, path+ext); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("got %v, want %v", got, test.want)
+				}
+				rotated, _ := filepath.Glob(filepath.Join(dir, "metric.*.csv"+ext))
+				switch {
+				case test.rolled == nil && len(rotated) != 0:
+					t.Errorf("got rotated files %v, want none", rotated)
+				case test.rolled != nil && len(rotated) != 1:
+					t.Errorf("got rotated files %v, want one", rotated)
+				case test.rolled != nil:
+					if got := readCSV(t, rotated[0]); !reflect.DeepEqual(got, test.rolled) {
+						t.Errorf("rotated file: got %v, want %v", got, test.rolled)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFileCacheAppendsToCompressedFile(t *testing.T) {
+	for _, compression := range compressions {
+		t.Run(compression, func(t *testing.T) {
+			cache := NewFileCache(0)
+			cache.SetCompression(compression)
+			path := filepath.Join(t.TempDir(), "metric.csv")
+			header := []string{"timestamp", "value"}
+			for _, record := range [][]string{{"1", "a"}, {"2", "b"}} {
+				if err := cache.WriteCSV(path, header, record); err != nil {
+					t.Fatal(err)
+				}
+				// The second write appends a new gzip member or zstd frame.
+				if err := cache.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := [][]string{header, {"1", "a"}, {"2", "b"}}
+			if got := readCSV(t, path+compressionExts[compression]); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFileCacheRotatesBySize(t *testing.T) {
+	for _, compression := range compressions {
+		t.Run(compression, func(t *testing.T) {
+			cache := NewFileCache(0)
+			cache.SetCompression(compression)
+			cache.SetRotation(RotationOptions{MaxSize: 1})
+			dir := t.TempDir()
+			path := filepath.Join(dir, "metric.csv")
+			header := []string{"timestamp", "value"}
+			for i := 0; i < 3; i++ {
+				if err := cache.WriteCSV(path, header, []string{strconv.Itoa(i), "x"}); err != nil {
+					t.Fatal(err)
+				}
+				// Sizes are only known once the data reached the file.
+				if err := cache.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cache.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows := make(map[string]bool)
+			var rotated int
+			for _, entry := range entries {
+				file := filepath.Join(dir, entry.Name())
+				if IsRotatedFile(file) {
+					rotated++
+				} else if entry.Name() != "metric.csv"+compressionExts[compression] {
+					t.Errorf("unexpected file %s", entry.Name())
+				}
+				if compressionOf(file) != compression {
+					t.Errorf("file %s is not compressed with %s", entry.Name(), compression)
+				}
+				got := readCSV(t, file)
+				if len(got) != 2 || !reflect.DeepEqual(got[0], header) {
+					t.Errorf("file %s holds %v, want the header and one row", entry.Name(), got)
+					continue
+				}
+				rows[got[1][0]] = true
+			}
+			if rotated != 2 || len(rows) != 3 {
+				t.Errorf("got %d rotated files with rows %v, want 2 holding 3 rows in total", rotated, rows)
+			}
+		})
+	}
+}
+
+func TestFileCacheRotatesByAge(t *testing.T) {
+	cache := NewFileCache(0)
+	cache.SetRotation(RotationOptions{Interval: time.Millisecond})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metric.csv")
+	cache.WriteCSV(path, []string{"value"}, []string{"1"})
+	time.Sleep(5 * time.Millisecond)
+	cache.WriteCSV(path, []string{"value"}, []string{"2"})
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "metric.*.csv")); len(files) != 1 || !IsRotatedFile(files[0]) {
+		t.Errorf("got files %v, want one rotated file", files)
+	}
+}
+
+func TestFileCacheRotatesLeftoverFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metric.csv")
+	if err := os.WriteFile(path, []byte("value\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewFileCache(0)
+	cache.SetRotation(RotationOptions{Interval: time.Minute})
+	if err := cache.WriteCSV(path, []string{"value"}, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readCSV(t, path), [][]string{{"value"}, {"2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "metric.*.csv")); len(files) != 1 || !IsRotatedFile(files[0]) {
+		t.Errorf("got files %v, want the leftover file rotated", files)
+	}
+}
+
+func TestWriteVersionedCSV(t *testing.T) {
+	for _, compression := range compressions {
+		t.Run(compression, func(t *testing.T) {
+			cache := NewFileCache(0)
+			cache.SetCompression(compression)
+			dir := t.TempDir()
+			path := filepath.Join(dir, "started.csv")
+			cache.WriteVersionedCSV(path, []string{"a", "b"}, []string{"1", "2"})
+			cache.WriteVersionedCSV(path, []string{"a", "b"}, []string{"3", "4"})
+			cache.Close()
+			// Restarted with another schema.
+			if err := cache.WriteVersionedCSV(path, []string{"a", "c"}, []string{"5", "6"}); err != nil {
+				t.Fatal(err)
+			}
+			cache.Close()
+
+			ext := compressionExts[compression]
+			want := [][]string{{"a", "c"}, {"5", "6"}}
+			if got := readCSV(t, path+ext); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			legacy, _ := filepath.Glob(filepath.Join(dir, "started.*.csv"+ext))
+			if len(legacy) != 1 {
+				t.Fatalf("got legacy files %v, want one", legacy)
+			}
+			want = [][]string{{"a", "b"}, {"1", "2"}, {"3", "4"}}
+			if got := readCSV(t, legacy[0]); !reflect.DeepEqual(got, want) {
+				t.Errorf("legacy file: got %v, want %v", got, want)
+			}
+		})
+	}
+}
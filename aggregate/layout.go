@@ -0,0 +1,89 @@
+package aggregate
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Layouts of the CSV output.
+const (
+	// <dir>/<target>/<source>/<query>/<query>.csv shared by all tasks (default).
+	LayoutShared = "shared"
+	// <dir>/<task>-<id>/<target>/<source>/<query>.csv per task.
+	LayoutTaskDir = "task_dir"
+	// <dir>/<task>-<id>.csv holding all metrics of a task.
+	LayoutTaskFile = "task_file"
+)
+
+// Length of the container ID prefix in task paths, as shown by docker ps.
+const shortIDLength = 12
+
+// TaskPathName names a task's directory or file. The container ID keeps
+// tasks apart whose Nextflow name was reused.
+func TaskPathName(task TaskInfo) string {
+	id := task.ContainerID
+	if len(id) > shortIDLength {
+		id = id[:shortIDLength]
+	}
+	if id == "" {
+		return task.Name
+	}
+	return task.Name + "-" + id
+}
+
+// writeTaskDirSeries writes a series to
+// <dir>/<task>-<id>/<target>/<source>/<query>.csv with the same columns as the
+// shared layout. Sources of a target may run the same query.
+func (s *CSVSink) writeTaskDirSeries(task TaskInfo, series Series) error {
+	v := &DataVectorWrapper{
+		QueryMetaInfo: map[string][]string{series.Source: series.LabelNames},
+		TaskStatus:    task.Status,
+	}
+	path := filepath.Join(s.dir, TaskPathName(task), series.Target, series.Source, series.Query+".csv")
+	return v.WriteSamplesToCSV(series.Source, path, series.Samples, series.Unit)
+}
+
+// writeTaskFileSeries appends a series to <dir>/<task>-<id>.csv. Since the
+// sources have different labels, they are joined into a single column.
+func (s *CSVSink) writeTaskFileSeries(task TaskInfo, series Series) error {
+	header := []string{"timestamp", "target", "source", "metric", "unit", "value", "labels"}
+	if task.Status != "" {
+		header = append(header, "task_status")
+	}
+
+	var records [][]string
+	for _, sample := range series.Samples {
+		labels := formatLabels(series.LabelNames, sample.Metric)
+		for _, pair := range sample.Values {
+			record := []string{
+				FormatTime(pair.Timestamp.Time()),
+				series.Target,
+				series.Source,
+				series.Query,
+				series.Unit,
+				fmt.Sprintf("%f", float64(pair.Value)),
+				labels,
+			}
+			if task.Status != "" {
+				record = append(record, task.Status)
+			}
+			records = append(records, record)
+		}
+	}
+	return WriteCSV(filepath.Join(s.dir, TaskPathName(task)+".csv"), header, records...)
+}
+
+// formatLabels renders the configured labels as name=value pairs.
+func formatLabels(names []string, metric model.Metric) string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	pairs := make([]string, 0, len(sorted))
+	for _, name := range sorted {
+		pairs = append(pairs, name+"="+string(metric[model.LabelName(name)]))
+	}
+	return strings.Join(pairs, ";")
+}
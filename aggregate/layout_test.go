@@ -0,0 +1,32 @@
+package aggregate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTaskDirLayoutKeepsSourcesApart(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewCSVSink(dir, LayoutTaskDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := TaskInfo{Name: "task", ContainerID: "0123456789abcdef"}
+	for _, source := range []string{"cadvisor", "ebpf"} {
+		series := testSeries("node", 1, 2)
+		series.Source = source
+		if err := sink.WriteSeries(task, series); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := OutputFiles.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"cadvisor", "ebpf"} {
+		path := filepath.Join(dir, "task-0123456789ab", "node", source, "container_memory_usage_bytes.csv")
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+}
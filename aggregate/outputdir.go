@@ -0,0 +1,23 @@
+package aggregate
+
+import "sync"
+
+var (
+	outputDirMu sync.RWMutex
+	outputDir   = DefaultOutputDir
+)
+
+// SetOutputDir changes the directory all result files are written to, e.g.
+// to the directory of the current run.
+func SetOutputDir(dir string) {
+	outputDirMu.Lock()
+	defer outputDirMu.Unlock()
+	outputDir = dir
+}
+
+// OutputDir returns the directory result files are written to.
+func OutputDir() string {
+	outputDirMu.RLock()
+	defer outputDirMu.RUnlock()
+	return outputDir
+}
@@ -0,0 +1,214 @@
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/prometheus/common/model"
+	"github.com/sirupsen/logrus"
+)
+
+// Partitioning of the Parquet output.
+const (
+	ParquetPerTarget = "target" // One file per monitoring target (default).
+	ParquetPerRun    = "run"    // A single file for the whole run.
+)
+
+const (
+	defaultRowGroupSize = 100000
+	defaultRollTasks    = 100
+	defaultRollInterval = 10 * time.Minute
+)
+
+// ParquetOptions configures the Parquet sink.
+type ParquetOptions struct {
+	Partition    string
+	RowGroupSize int64  // Rows per row group.
+	Compression  string // none, snappy (default), gzip or zstd.
+	// A new set of files is started after this many tasks or once the
+	// current files are this old, so a crash only loses the latest part.
+	RollTasks    int
+	RollInterval time.Duration
+}
+
+var parquetCodecs = map[string]compress.Codec{
+	"none":   &parquet.Uncompressed,
+	"snappy": &parquet.Snappy,
+	"gzip":   &parquet.Gzip,
+	"zstd":   &parquet.Zstd,
+}
+
+// parquetRow is one sample with typed columns.
+type parquetRow struct {
+	Container   string            `parquet:"container,dict"`
+	ContainerID string            `parquet:"container_id,dict"`
+	Worker      string            `parquet:"worker,dict"`
+	Target      string            `parquet:"target,dict"`
+	Source      string            `parquet:"source,dict"`
+	Metric      string            `parquet:"metric,dict"`
+	Unit        string            `parquet:"unit,dict"`
+	Timestamp   int64             `parquet:"timestamp,timestamp(nanosecond)"`
+	Value       float64           `parquet:"value"`
+	TaskStatus  string            `parquet:"task_status,optional,dict"`
+	Labels      map[string]string `parquet:"labels"`
+}
+
+type parquetFile struct {
+	file   *os.File
+	writer *parquet.GenericWriter[parquetRow]
+	size   int64
+}
+
+// ParquetSink writes the samples of all tasks to <dir>/parquet. Files are
+// named after their partition, the time the sink was created and a part
+// number. A file is only complete once its part was rolled or the sink is
+// closed.
+type ParquetSink struct {
+	mu      sync.Mutex // Guards the files and the roll state.
+	dir     string
+	opts    ParquetOptions
+	codec   compress.Codec
+	created time.Time
+	files   map[string]*parquetFile
+	part    int       // Number of the files being written.
+	tasks   int       // Tasks ended since the part was started.
+	started time.Time // Start of the part.
+}
+
+func NewParquetSink(dir string, opts ParquetOptions) (*ParquetSink, error) {
+	switch opts.Partition {
+	case "":
+		opts.Partition = ParquetPerTarget
+	case ParquetPerTarget, ParquetPerRun:
+	default:
+		return nil, fmt.Errorf("unknown parquet partition %q", opts.Partition)
+	}
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = defaultRowGroupSize
+	}
+	if opts.Compression == "" {
+		opts.Compression = "snappy"
+	}
+	if opts.RollTasks <= 0 {
+		opts.RollTasks = defaultRollTasks
+	}
+	if opts.RollInterval <= 0 {
+		opts.RollInterval = defaultRollInterval
+	}
+	codec, ok := parquetCodecs[opts.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown parquet compression %q", opts.Compression)
+	}
+	now := time.Now()
+	return &ParquetSink{
+		dir:     filepath.Join(dir, "parquet"),
+		opts:    opts,
+		codec:   codec,
+		created: now,
+		files:   make(map[string]*parquetFile),
+		started: now,
+	}, nil
+}
+
+func (s *ParquetSink) BeginTask(task TaskInfo) error { return nil }
+
+func (s *ParquetSink) WriteSeries(task TaskInfo, series Series) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	partition := ParquetPerRun
+	if s.opts.Partition == ParquetPerTarget {
+		partition = series.Target
+	}
+	f, err := s.open(partition)
+	if err != nil {
+		return err
+	}
+
+	var rows []parquetRow
+	for _, sample := range series.Samples {
+		labels := make(map[string]string, len(series.LabelNames))
+		for _, name := range series.LabelNames {
+			if value, ok := sample.Metric[model.LabelName(name)]; ok {
+				labels[name] = string(value)
+			}
+		}
+		for _, pair := range sample.Values {
+			rows = append(rows, parquetRow{
+				Container:   task.Name,
+				ContainerID: task.ContainerID,
+				Worker:      task.WorkerIP,
+				Target:      series.Target,
+				Source:      series.Source,
+				Metric:      series.Query,
+				Unit:        series.Unit,
+				Timestamp:   pair.Timestamp.Time().UnixNano(),
+				Value:       float64(pair.Value),
+				TaskStatus:  task.Status,
+				Labels:      labels,
+			})
+		}
+	}
+	if _, err := f.writer.Write(rows); err != nil {
+		return fmt.Errorf("error writing parquet rows: %w", err)
+	}
+	return nil
+}
+
+func (s *ParquetSink) open(partition string) (*parquetFile, error) {
+	if f, ok := s.files[partition]; ok {
+		return f, nil
+	}
+	if _, err := CreateOutputFolder(s.dir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%s.%d.%d.parquet", partition, s.created.Unix(), s.part))
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Writing parquet output to %s", path)
+	f := &parquetFile{file: file}
+	f.writer = parquet.NewGenericWriter[parquetRow](sizeWriter{file, &f.size},
+		parquet.Compression(s.codec),
+		parquet.MaxRowsPerRowGroup(s.opts.RowGroupSize),
+	)
+	s.files[partition] = f
+	return f, nil
+}
+
+// EndTask rolls the files once enough tasks were written or they are old enough.
+func (s *ParquetSink) EndTask(task TaskInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks++
+	if s.tasks < s.opts.RollTasks && time.Since(s.started) < s.opts.RollInterval {
+		return nil
+	}
+	err := s.close()
+	s.part++
+	s.tasks = 0
+	s.started = time.Now()
+	return err
+}
+
+// Close writes the footers. Files that were not closed cannot be read.
+func (s *ParquetSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+func (s *ParquetSink) close() error {
+	var errs []error
+	for partition, f := range s.files {
+		errs = append(errs, f.writer.Close(), f.file.Close())
+		delete(s.files, partition)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,86 @@
+package aggregate
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func testSeries(target string, values ...float64) Series {
+	var pairs []model.SamplePair
+	for i, value := range values {
+		pairs = append(pairs, model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(value)})
+	}
+	return Series{
+		Target:  target,
+		Source:  "cadvisor",
+		Query:   "container_memory_usage_bytes",
+		Samples: model.Matrix{{Metric: model.Metric{}, Values: pairs}},
+	}
+}
+
+func TestParquetSinkRollsParts(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewParquetSink(dir, ParquetOptions{Partition: ParquetPerRun, RollTasks: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		task := TaskInfo{Name: "task", ContainerID: "id"}
+		if err := sink.WriteSeries(task, testSeries("cadvisor", 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.EndTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first part is complete before the sink is closed.
+	files, _ := filepath.Glob(filepath.Join(dir, "parquet", "*.parquet"))
+	sort.Strings(files)
+	if len(files) != 2 {
+		t.Fatalf("got files %v, want two parts", files)
+	}
+	description, err := DescribeFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.Rows != 4 {
+		t.Errorf("got %d rows in the first part, want 4", description.Rows)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	description, err = DescribeFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.Rows != 2 {
+		t.Errorf("got %d rows in the second part, want 2", description.Rows)
+	}
+}
+
+func TestParquetSinkRollsByAge(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewParquetSink(dir, ParquetOptions{RollInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	task := TaskInfo{Name: "task", ContainerID: "id"}
+	sink.WriteSeries(task, testSeries("node", 1))
+	if err := sink.EndTask(task); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "parquet", "node.*.parquet"))
+	if len(files) != 1 {
+		t.Fatalf("got files %v, want one", files)
+	}
+	if _, err := DescribeFile(files[0]); err != nil {
+		t.Errorf("part was not completed: %v", err)
+	}
+}
@@ -1,10 +1,11 @@
 package aggregate
 
 import (
-	"encoding/csv"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync/atomic"
 
 	"github.com/prometheus/common/model"
 	"github.com/sirupsen/logrus"
@@ -15,6 +16,8 @@ type DataVectorWrapper struct {
 	ResultMap     map[string]map[string]map[string]model.Matrix // Holds the map according to the config structure
 	QueryMetaInfo map[string][]string
 	QueryUnits    map[string]map[string]string
+	TaskStatus    string // Appended as task_status column when set.
+	OutputDir     string // Defaults to DefaultOutputDir.
 	// mu        sync.Mutex
 }
 
@@ -26,6 +29,14 @@ func NewDataVectorWrapper(m map[string]map[string]map[string]model.Matrix, qmi m
 	}
 }
 
+// Bytes of metric output written since start.
+var bytesWritten atomic.Int64
+
+// BytesWritten returns the number of bytes of metric output written so far.
+func BytesWritten() int64 {
+	return bytesWritten.Load()
+}
+
 // This func is called on a MetaDataVectorWrapper object so it can access the fileds of the struct.
 func (v *DataVectorWrapper) CreateDataOutput() error {
 	err := CreateMonitoringOutput(v)
@@ -37,14 +48,18 @@ func (v *DataVectorWrapper) CreateDataOutput() error {
 
 // TODO: Go over the queries with separate go routines.
 func CreateMonitoringOutput(v *DataVectorWrapper) error {
-	err := os.Mkdir("results", 0755)
-	if err != nil && !os.IsExist(err) {
+	outputDir := v.OutputDir
+	if outputDir == "" {
+		outputDir = DefaultOutputDir
+	}
+	err := os.MkdirAll(outputDir, 0755)
+	if err != nil {
 		logrus.Error("Error creating results directory: ", err)
 		return err
 	}
 
 	for target, dataSources := range v.ResultMap {
-		targetFolder := fmt.Sprintf("results/%s", target)
+		targetFolder := fmt.Sprintf("%s/%s", outputDir, target)
 		CreateOutputFolder(targetFolder)
 
 		for dataSource, queryNames := range dataSources {
@@ -55,25 +70,16 @@ func CreateMonitoringOutput(v *DataVectorWrapper) error {
 				queryFolder := fmt.Sprintf("%s/%s", sourceFolder, queryName)
 				CreateOutputFolder(queryFolder)
 
-				queryFile := CreateFile(queryFolder, queryName+".csv")
 				var unit string
 				if v.QueryUnits != nil {
 					if unitsForSource, ok := v.QueryUnits[dataSource]; ok {
 						unit = unitsForSource[queryName]
-						fmt.Printf("Unit for %s/%s: %s\n", dataSource, queryName, unit)
+						logrus.Debugf("Unit for %s/%s: %s", dataSource, queryName, unit)
 					}
 				}
 
-				for _, sample := range samples {
-					for _, pair := range sample.Values {
-						timestamp := pair.Timestamp.Time().Format("15:04:05.000")
-
-						// logrus.Infof("Writing Sample - Timestamp: %s, ID: %s, Value: %f",
-						// timestamp, sample.Metric["id"], float64(pair.Value))
-
-						v.WriteToCSV(dataSource, v.QueryMetaInfo, queryFolder, queryFile, timestamp, model.LabelSet(sample.Metric), float64(pair.Value), unit)
-						// logrus.Info("[QUERY Labels]: ", v.QueryMetaInfo)
-					}
+				if err := v.WriteSamplesToCSV(dataSource, filepath.Join(queryFolder, queryName+".csv"), samples, unit); err != nil {
+					logrus.Error("Error writing to CSV: ", err)
 				}
 			}
 		}
@@ -81,73 +87,26 @@ func CreateMonitoringOutput(v *DataVectorWrapper) error {
 	return nil
 }
 
-func (v *DataVectorWrapper) WriteToCSV(dataSource string, QueryMetaInfo map[string][]string, folder string, outputFile *os.File, timestamp string, metricLabels model.LabelSet, value float64, unit string) error {
-	w := csv.NewWriter(outputFile)
-	w.Comma = ','
-	defer w.Flush()
-
-	fileInfo, err := outputFile.Stat()
-	if err != nil {
-		return err
-	}
-	// if fileInfo.Size() == 0 {
-	// 	if err := w.Write(ReadHeaderFields(metricLabels)); err != nil {
-	// 		return err
-	// 	}
-	// }
-	if fileInfo.Size() == 0 {
-		if err := w.Write(ReadHeaderFields(dataSource, QueryMetaInfo, unit)); err != nil {
-			return err
+// WriteSamplesToCSV appends the samples to the CSV file at path, which is
+// kept open in OutputFiles for the following tasks.
+func (v *DataVectorWrapper) WriteSamplesToCSV(dataSource string, path string, samples model.Matrix, unit string) error {
+	header := ReadHeaderFields(dataSource, v.QueryMetaInfo, unit)
+	if v.TaskStatus != "" {
+		header = append(header, "task_status")
+	}
+
+	var records [][]string
+	for _, sample := range samples {
+		for _, pair := range sample.Values {
+			timestamp := FormatTime(pair.Timestamp.Time())
+			values := ReadLabelValues(dataSource, v.QueryMetaInfo, model.LabelSet(sample.Metric), timestamp, float64(pair.Value))
+			if v.TaskStatus != "" {
+				values = append(values, v.TaskStatus)
+			}
+			records = append(records, values)
 		}
 	}
-
-	// Write data to the file.
-	values := ReadLabelValues(dataSource, QueryMetaInfo, metricLabels, timestamp, value)
-
-	// pattern := `^nxf-[A-Za-z0-9]+$`
-	// re := regexp.MustCompile(pattern)
-	// for _, taskName := range metricLabels {
-	// fmt.Printf("Value: %f", value)
-	// if re.MatchString(taskName) {
-	// 	// fmt.Println("Found nextflow container")
-	// 	FilterNextflowJobs(folder, taskName, values)
-	// Also write all values into main file.
-	if err := w.Write(values); err != nil {
-		logrus.Error("Error writing to CSV")
-		return err
-	}
-	return nil
-}
-
-// if err := w.Write(values); err != nil {
-// 	logrus.Error("Error writing to CSV")
-// 	return err
-// }
-// 	return nil
-// }
-
-func FilterNextflowJobs(queryFolder string, taskName string, values []string) {
-	containerName := taskName
-
-	taskFolder, err := CreateOutputFolder(fmt.Sprintf("%s/%s", queryFolder, containerName))
-	// logrus.Infof("Created output folder for finished Task: %s", containerName)
-	if err != nil {
-		logrus.Error("Error creating task folder: ", err)
-	}
-	taskFile := CreateFile(taskFolder, containerName+".csv")
-	if taskFile == nil {
-		logrus.Error("Error creating task file")
-		return
-	}
-
-	tw := csv.NewWriter(taskFile)
-	tw.Comma = ','
-	defer tw.Flush()
-	if err := tw.Write(values); err != nil {
-		logrus.Error("Error writing to CSV")
-
-	}
-	// fmt.Println("Values: ", values)
+	return WriteCSV(path, header, records...)
 }
 
 // Helper to create folder.
@@ -232,21 +191,36 @@ func ReadLabelValues(dataSource string, QueryMetaInfo map[string][]string, label
 		return nil
 	}
 
-	keys := make([]string, 0, len(labels))
-	keys = append(keys, labels...)
-	// logrus.Infof("QueryMetaInfo: %v", QueryMetaInfo)
-	sort.Strings(keys)
-
-	for _, key := range keys {
+	// Same order as the header.
+	for _, key := range labels {
 		record = append(record, string(labelValues[model.LabelName(key)]))
 	}
 	return record
 }
 
+// ReturnedLabelNames returns the sorted union of the labels of the samples,
+// without the metric name.
+func ReturnedLabelNames(samples model.Matrix) []string {
+	seen := make(map[model.LabelName]struct{})
+	for _, sample := range samples {
+		for name := range sample.Metric {
+			seen[name] = struct{}{}
+		}
+	}
+	delete(seen, model.MetricNameLabel)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
 func GetFileIdentifier(sample model.Sample) string {
 	return sample.Value.String()
 }
 
 func GetTimeStamp(sample model.Sample) string {
-	return sample.Timestamp.Time().Format("15:04:05")
+	return FormatTime(sample.Timestamp.Time())
 }
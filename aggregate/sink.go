@@ -0,0 +1,257 @@
+package aggregate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Default directory the sinks write to.
+const DefaultOutputDir = "results"
+
+// TaskInfo identifies the task a series belongs to.
+type TaskInfo struct {
+	Name        string
+	ContainerID string
+	WorkerIP    string
+	StartTime   time.Time
+	DieTime     time.Time
+	Status      string // Written with every sample when set.
+
+	// Details of the container, for sinks that store tasks themselves.
+	WorkDir       string
+	Image         string
+	ExitStatus    string // succeeded, failed or oom_killed.
+	ExitCode      int
+	OOMKilled     bool
+	AllocatedCPUs float64
+	MemoryLimit   int64
+	Events        []TaskEvent
+}
+
+// TaskEvent is a Docker lifecycle event of the task's container.
+type TaskEvent struct {
+	Time     time.Time
+	Action   string
+	Signal   string
+	ExitCode string
+}
+
+// Series holds the result of one query for one task.
+type Series struct {
+	Target     string
+	Source     string
+	Query      string
+	Unit       string
+	LabelNames []string // Labels configured for the source.
+	Samples    model.Matrix
+}
+
+// OutputSink receives the metrics of finished tasks. Sinks are safe for
+// concurrent use by several tasks. Every BeginTask is followed by an EndTask
+// for the same task, even if BeginTask failed.
+type OutputSink interface {
+	BeginTask(task TaskInfo) error
+	WriteSeries(task TaskInfo, series Series) error
+	EndTask(task TaskInfo) error
+	Close() error
+}
+
+// SinkOptions configures the sinks. Each sink only reads its own options.
+type SinkOptions struct {
+	Layout  string // CSV layout, shared by default.
+	Parquet ParquetOptions
+}
+
+// SinkFactory creates a sink writing below dir.
+type SinkFactory func(dir string, opts SinkOptions) (OutputSink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"csv":   func(dir string, opts SinkOptions) (OutputSink, error) { return NewCSVSink(dir, opts.Layout) },
+	"jsonl": func(dir string, opts SinkOptions) (OutputSink, error) { return NewJSONLSink(dir), nil },
+	"parquet": func(dir string, opts SinkOptions) (OutputSink, error) {
+		return NewParquetSink(dir, opts.Parquet)
+	},
+	"sqlite": func(dir string, opts SinkOptions) (OutputSink, error) {
+		return NewSQLiteSink(dir)
+	},
+}
+
+// RegisterSink makes an output format selectable by name. It is meant to be
+// called from init functions, not concurrently with NewSink.
+func RegisterSink(format string, factory SinkFactory) {
+	sinkFactories[format] = factory
+}
+
+// NewSink creates the sinks for the given formats, combined into one if more
+// than one is requested. CSV is used when no format is given.
+func NewSink(dir string, formats []string, opts SinkOptions) (OutputSink, error) {
+	if len(formats) == 0 {
+		formats = []string{"csv"}
+	}
+	var sinks MultiSink
+	for _, format := range formats {
+		factory, ok := sinkFactories[format]
+		if !ok {
+			sinks.Close()
+			return nil, fmt.Errorf("unknown output format %q", format)
+		}
+		sink, err := factory(dir, opts)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("error creating %s output: %w", format, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// MultiSink writes to several sinks. A failing sink does not keep the others
+// from receiving the data.
+type MultiSink []OutputSink
+
+func (m MultiSink) BeginTask(task TaskInfo) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.BeginTask(task))
+	}
+	return errors.Join(errs...)
+}
+
+func (m MultiSink) WriteSeries(task TaskInfo, series Series) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.WriteSeries(task, series))
+	}
+	return errors.Join(errs...)
+}
+
+func (m MultiSink) EndTask(task TaskInfo) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.EndTask(task))
+	}
+	return errors.Join(errs...)
+}
+
+func (m MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// CSVSink writes CSV files in one of the layouts.
+type CSVSink struct {
+	dir    string
+	layout string
+}
+
+func NewCSVSink(dir, layout string) (*CSVSink, error) {
+	switch layout {
+	case "":
+		layout = LayoutShared
+	case LayoutShared, LayoutTaskDir, LayoutTaskFile:
+	default:
+		return nil, fmt.Errorf("unknown CSV layout %q", layout)
+	}
+	return &CSVSink{dir: dir, layout: layout}, nil
+}
+
+func (s *CSVSink) BeginTask(task TaskInfo) error { return nil }
+
+func (s *CSVSink) WriteSeries(task TaskInfo, series Series) error {
+	switch s.layout {
+	case LayoutTaskDir:
+		return s.writeTaskDirSeries(task, series)
+	case LayoutTaskFile:
+		return s.writeTaskFileSeries(task, series)
+	}
+
+	v := NewDataVectorWrapper(map[string]map[string]map[string]model.Matrix{
+		series.Target: {
+			series.Source: {
+				series.Query: series.Samples,
+			},
+		},
+	}, map[string][]string{
+		series.Source: series.LabelNames,
+	}, map[string]map[string]string{
+		series.Source: {series.Query: series.Unit},
+	})
+	v.TaskStatus = task.Status
+	v.OutputDir = s.dir
+	return CreateMonitoringOutput(v)
+}
+
+// EndTask flushes the buffered records so a finished task is complete on disk.
+func (s *CSVSink) EndTask(task TaskInfo) error { return OutputFiles.Flush() }
+
+func (s *CSVSink) Close() error { return OutputFiles.Flush() }
+
+// JSONLSink writes one JSON object per sample to <dir>/metrics.jsonl.
+type JSONLSink struct {
+	dir string
+}
+
+func NewJSONLSink(dir string) *JSONLSink {
+	return &JSONLSink{dir: dir}
+}
+
+type jsonlSample struct {
+	Task        string            `json:"task"`
+	ContainerID string            `json:"container_id"`
+	Node        string            `json:"node,omitempty"`
+	Status      string            `json:"task_status,omitempty"`
+	Target      string            `json:"target"`
+	Source      string            `json:"source"`
+	Query       string            `json:"query"`
+	Unit        string            `json:"unit,omitempty"`
+	Timestamp   string            `json:"timestamp"` // See FormatTime.
+	Value       float64           `json:"value"`
+	Labels      map[string]string `json:"labels"`
+}
+
+func (s *JSONLSink) BeginTask(task TaskInfo) error { return nil }
+
+func (s *JSONLSink) WriteSeries(task TaskInfo, series Series) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, sample := range series.Samples {
+		labels := make(map[string]string, len(sample.Metric))
+		for name, value := range sample.Metric {
+			labels[string(name)] = string(value)
+		}
+		for _, pair := range sample.Values {
+			if err := encoder.Encode(jsonlSample{
+				Task:        task.Name,
+				ContainerID: task.ContainerID,
+				Node:        task.WorkerIP,
+				Status:      task.Status,
+				Target:      series.Target,
+				Source:      series.Source,
+				Query:       series.Query,
+				Unit:        series.Unit,
+				Timestamp:   FormatTime(pair.Timestamp.Time()),
+				Value:       float64(pair.Value),
+				Labels:      labels,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return OutputFiles.Write(filepath.Join(s.dir, "metrics.jsonl"), buffer.Bytes())
+}
+
+func (s *JSONLSink) EndTask(task TaskInfo) error { return OutputFiles.Flush() }
+
+func (s *JSONLSink) Close() error { return OutputFiles.Flush() }
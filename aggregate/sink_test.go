@@ -0,0 +1,110 @@
+package aggregate
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		formats []string
+		opts    SinkOptions
+		valid   bool
+	}{
+		{"default", nil, SinkOptions{}, true},
+		{"combined", []string{"csv", "parquet"}, SinkOptions{Layout: LayoutTaskDir}, true},
+		{"unknown format", []string{"xml"}, SinkOptions{}, false},
+		{"unknown layout", []string{"csv"}, SinkOptions{Layout: "nested"}, false},
+		{"unknown partition", []string{"parquet"}, SinkOptions{Parquet: ParquetOptions{Partition: "day"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink, err := NewSink(t.TempDir(), test.formats, test.opts)
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %v", err, test.valid)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+func TestSinksWriteConcurrentTasks(t *testing.T) {
+	dir := t.TempDir()
+	defer OutputFiles.Close()
+	sink, err := NewSink(dir, []string{"sqlite", "parquet", "jsonl"}, SinkOptions{Parquet: ParquetOptions{Partition: ParquetPerRun, RollTasks: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const tasks = 8
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task := TaskInfo{Name: "task", ContainerID: fmt.Sprintf("id-%d", i), DieTime: time.Unix(int64(i), 0)}
+			if err := sink.BeginTask(task); err != nil {
+				t.Error(err)
+			}
+			for _, target := range []string{"cpu", "memory"} {
+				if err := sink.WriteSeries(task, testSeries(target, 1, 2, 3)); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := sink.EndTask(task); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := OutputFiles.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const samples = tasks * 2 * 3
+	db, err := sql.Open("sqlite", filepath.Join(dir, sqliteFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var taskRows, sampleRows int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM tasks), (SELECT COUNT(*) FROM samples)`).Scan(&taskRows, &sampleRows); err != nil {
+		t.Fatal(err)
+	}
+	if taskRows != tasks || sampleRows != samples {
+		t.Errorf("got %d tasks and %d samples in SQLite, want %d and %d", taskRows, sampleRows, tasks, samples)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "parquet", "*.parquet"))
+	var parquetRows int64
+	for _, file := range files {
+		description, err := DescribeFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parquetRows += description.Rows
+	}
+	if parquetRows != samples {
+		t.Errorf("got %d parquet rows, want %d", parquetRows, samples)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "metrics.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != samples {
+		t.Errorf("got %d JSONL lines, want %d", lines, samples)
+	}
+}
@@ -0,0 +1,258 @@
+package aggregate
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	_ "modernc.org/sqlite" // Pure-Go driver, registers "sqlite".
+)
+
+// Name of the database file below the output directory.
+const sqliteFileName = "results.db"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS tasks (
+	id             INTEGER PRIMARY KEY,
+	name           TEXT NOT NULL,
+	container_id   TEXT NOT NULL,
+	worker         TEXT,
+	work_dir       TEXT,
+	image          TEXT,
+	start_time     INTEGER,
+	die_time       INTEGER,
+	status         TEXT,
+	exit_code      INTEGER,
+	oom_killed     INTEGER,
+	allocated_cpus REAL,
+	memory_limit   INTEGER,
+	UNIQUE (container_id, die_time)
+);
+CREATE INDEX IF NOT EXISTS tasks_name ON tasks (name);
+CREATE INDEX IF NOT EXISTS tasks_container_id ON tasks (container_id);
+
+CREATE TABLE IF NOT EXISTS lifecycle_events (
+	task_id   INTEGER NOT NULL REFERENCES tasks (id),
+	time      INTEGER NOT NULL,
+	action    TEXT NOT NULL,
+	signal    TEXT,
+	exit_code TEXT
+);
+CREATE INDEX IF NOT EXISTS lifecycle_events_task ON lifecycle_events (task_id);
+
+CREATE TABLE IF NOT EXISTS metrics (
+	id     INTEGER PRIMARY KEY,
+	target TEXT NOT NULL,
+	source TEXT NOT NULL,
+	name   TEXT NOT NULL,
+	unit   TEXT,
+	labels TEXT,
+	UNIQUE (target, source, name)
+);
+
+CREATE TABLE IF NOT EXISTS samples (
+	task_id   INTEGER NOT NULL REFERENCES tasks (id),
+	metric_id INTEGER NOT NULL REFERENCES metrics (id),
+	timestamp INTEGER NOT NULL,
+	value     REAL NOT NULL,
+	labels    TEXT
+);
+CREATE INDEX IF NOT EXISTS samples_task ON samples (task_id);
+CREATE INDEX IF NOT EXISTS samples_metric ON samples (metric_id);
+`
+
+// SQLiteSink writes tasks, their lifecycle events, metric metadata and
+// samples into a single SQLite database. Times are stored as Unix
+// nanoseconds, labels as JSON objects. Every task is written in one
+// transaction. The database has a single connection, so concurrent tasks wait
+// in BeginTask until the running one ended.
+type SQLiteSink struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	tasks map[string]*sqliteTask // Transactions of the tasks being written.
+}
+
+type sqliteTask struct {
+	tx *sql.Tx
+	id int64
+}
+
+func NewSQLiteSink(dir string) (*SQLiteSink, error) {
+	if _, err := CreateOutputFolder(dir); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + filepath.Join(dir, sqliteFileName) + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating database schema: %w", err)
+	}
+	return &SQLiteSink{db: db, tasks: make(map[string]*sqliteTask)}, nil
+}
+
+// sqliteTaskKey identifies a task run, like the tasks table does.
+func sqliteTaskKey(task TaskInfo) string {
+	return fmt.Sprintf("%s/%d", task.ContainerID, task.DieTime.UnixNano())
+}
+
+func unixNano(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+func (s *SQLiteSink) BeginTask(task TaskInfo) error {
+	key := sqliteTaskKey(task)
+	if t := s.take(key); t != nil {
+		t.tx.Rollback()
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	t := &sqliteTask{tx: tx}
+
+	// A task processed again after a restart replaces its earlier rows.
+	var previous int64
+	err = tx.QueryRow(`SELECT id FROM tasks WHERE container_id = ? AND die_time IS ?`, task.ContainerID, unixNano(task.DieTime)).Scan(&previous)
+	switch {
+	case err == nil:
+		for _, table := range []string{"samples", "lifecycle_events"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE task_id = ?`, previous); err != nil {
+				return t.abort(err)
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM tasks WHERE id = ?`, previous); err != nil {
+			return t.abort(err)
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return t.abort(err)
+	}
+
+	result, err := tx.Exec(`INSERT INTO tasks (name, container_id, worker, work_dir, image, start_time, die_time, status, exit_code, oom_killed, allocated_cpus, memory_limit)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		task.Name, task.ContainerID, task.WorkerIP, task.WorkDir, task.Image,
+		unixNano(task.StartTime), unixNano(task.DieTime), task.ExitStatus,
+		task.ExitCode, task.OOMKilled, task.AllocatedCPUs, task.MemoryLimit)
+	if err != nil {
+		return t.abort(fmt.Errorf("error inserting task: %w", err))
+	}
+	if t.id, err = result.LastInsertId(); err != nil {
+		return t.abort(err)
+	}
+
+	for _, event := range task.Events {
+		if _, err := tx.Exec(`INSERT INTO lifecycle_events (task_id, time, action, signal, exit_code) VALUES (?, ?, ?, ?, ?)`,
+			t.id, unixNano(event.Time), event.Action, event.Signal, event.ExitCode); err != nil {
+			return t.abort(fmt.Errorf("error inserting lifecycle event: %w", err))
+		}
+	}
+
+	s.mu.Lock()
+	s.tasks[key] = t
+	s.mu.Unlock()
+	return nil
+}
+
+// task returns the transaction of a begun task.
+func (s *SQLiteSink) task(key string) *sqliteTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tasks[key]
+}
+
+// take removes the transaction of a task and returns it.
+func (s *SQLiteSink) take(key string) *sqliteTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tasks[key]
+	delete(s.tasks, key)
+	return t
+}
+
+func (t *sqliteTask) abort(err error) error {
+	t.tx.Rollback()
+	return err
+}
+
+func (s *SQLiteSink) abort(key string, t *sqliteTask, err error) error {
+	s.take(key)
+	return t.abort(err)
+}
+
+func (t *sqliteTask) metricID(series Series) (int64, error) {
+	labels, err := json.Marshal(series.LabelNames)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = t.tx.QueryRow(`INSERT INTO metrics (target, source, name, unit, labels) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (target, source, name) DO UPDATE SET unit = excluded.unit, labels = excluded.labels
+		RETURNING id`,
+		series.Target, series.Source, series.Query, series.Unit, string(labels)).Scan(&id)
+	return id, err
+}
+
+func (s *SQLiteSink) WriteSeries(task TaskInfo, series Series) error {
+	key := sqliteTaskKey(task)
+	t := s.task(key)
+	if t == nil {
+		return errors.New("no task begun")
+	}
+	metricID, err := t.metricID(series)
+	if err != nil {
+		return s.abort(key, t, fmt.Errorf("error inserting metric: %w", err))
+	}
+
+	stmt, err := t.tx.Prepare(`INSERT INTO samples (task_id, metric_id, timestamp, value, labels) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return s.abort(key, t, err)
+	}
+	defer stmt.Close()
+	for _, sample := range series.Samples {
+		labels := make(map[string]string, len(series.LabelNames))
+		for _, name := range series.LabelNames {
+			if value, ok := sample.Metric[model.LabelName(name)]; ok {
+				labels[name] = string(value)
+			}
+		}
+		encoded, err := json.Marshal(labels)
+		if err != nil {
+			return s.abort(key, t, err)
+		}
+		for _, pair := range sample.Values {
+			if _, err := stmt.Exec(t.id, metricID, pair.Timestamp.Time().UnixNano(), float64(pair.Value), string(encoded)); err != nil {
+				return s.abort(key, t, fmt.Errorf("error inserting samples: %w", err))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteSink) EndTask(task TaskInfo) error {
+	t := s.take(sqliteTaskKey(task))
+	if t == nil {
+		return errors.New("no task begun")
+	}
+	return t.tx.Commit()
+}
+
+func (s *SQLiteSink) Close() error {
+	s.mu.Lock()
+	for key, t := range s.tasks {
+		t.tx.Rollback()
+		delete(s.tasks, key)
+	}
+	s.mu.Unlock()
+	return s.db.Close()
+}
@@ -0,0 +1,61 @@
+package aggregate
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time formats of the CSV output. Any other value is used as a Go time layout.
+const (
+	TimeRFC3339Nano = "rfc3339nano" // 2006-01-02T15:04:05.999999999Z07:00 (default).
+	TimeUnixMilli   = "unix_ms"     // Milliseconds since the epoch.
+	TimeUnixNano    = "unix_ns"     // Nanoseconds since the epoch.
+)
+
+var (
+	timeFormatMu sync.RWMutex
+	timeFormat   = TimeRFC3339Nano
+	timeLocation = time.UTC
+)
+
+// SetTimeFormat sets how timestamps are written to the CSV output. The
+// timezone is UTC if empty, Local or an IANA name like Europe/Berlin.
+func SetTimeFormat(format, timezone string) error {
+	if format == "" {
+		format = TimeRFC3339Nano
+	}
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q: %w", timezone, err)
+		}
+	}
+
+	timeFormatMu.Lock()
+	defer timeFormatMu.Unlock()
+	timeFormat = format
+	timeLocation = location
+	return nil
+}
+
+// FormatTime formats a timestamp of the output. Zero times are left empty.
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	timeFormatMu.RLock()
+	defer timeFormatMu.RUnlock()
+
+	switch timeFormat {
+	case TimeUnixMilli:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case TimeUnixNano:
+		return strconv.FormatInt(t.UnixNano(), 10)
+	case TimeRFC3339Nano:
+		return t.In(timeLocation).Format(time.RFC3339Nano)
+	}
+	return t.In(timeLocation).Format(timeFormat)
+}
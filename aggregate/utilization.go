@@ -0,0 +1,103 @@
+package aggregate
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"github.com/sirupsen/logrus"
+)
+
+// TaskUtilization relates what a task used to what it was allocated. Ratios
+// are left at zero when the limit is unknown or unlimited.
+type TaskUtilization struct {
+	Name          string
+	ContainerID   string
+	MemoryLimit   int64
+	PeakMemory    float64
+	MemoryRatio   float64
+	AllocatedCPUs float64
+	MeanCores     float64
+	CPURatio      float64
+}
+
+// ComputeUtilization derives peak memory from a memory gauge and the mean
+// number of busy cores from a cumulative CPU seconds counter.
+func ComputeUtilization(name, containerID string, memory, cpu model.Matrix, memoryLimit int64, allocatedCPUs float64) TaskUtilization {
+	u := TaskUtilization{
+		Name:          name,
+		ContainerID:   containerID,
+		MemoryLimit:   memoryLimit,
+		AllocatedCPUs: allocatedCPUs,
+		PeakMemory:    peakOfSum(memory),
+		MeanCores:     meanRate(cpu),
+	}
+	if memoryLimit > 0 {
+		u.MemoryRatio = u.PeakMemory / float64(memoryLimit)
+	}
+	if allocatedCPUs > 0 {
+		u.CPURatio = u.MeanCores / allocatedCPUs
+	}
+	return u
+}
+
+// peakOfSum sums all series per timestamp and returns the maximum.
+func peakOfSum(m model.Matrix) float64 {
+	sums := make(map[model.Time]float64)
+	for _, series := range m {
+		for _, pair := range series.Values {
+			sums[pair.Timestamp] += float64(pair.Value)
+		}
+	}
+	var peak float64
+	for _, sum := range sums {
+		if sum > peak {
+			peak = sum
+		}
+	}
+	return peak
+}
+
+// meanRate returns the summed per-second increase of counters over their
+// sampled range, accounting for counter resets.
+func meanRate(m model.Matrix) float64 {
+	var rate float64
+	for _, series := range m {
+		if len(series.Values) < 2 {
+			continue
+		}
+		var increase float64
+		for i := 1; i < len(series.Values); i++ {
+			delta := float64(series.Values[i].Value - series.Values[i-1].Value)
+			if delta < 0 {
+				delta = float64(series.Values[i].Value)
+			}
+			increase += delta
+		}
+		first, last := series.Values[0].Timestamp, series.Values[len(series.Values)-1].Timestamp
+		if seconds := last.Sub(first).Seconds(); seconds > 0 {
+			rate += increase / seconds
+		}
+	}
+	return rate
+}
+
+// WriteUtilizationToOutput appends the task's utilization to the run summary.
+func WriteUtilizationToOutput(u TaskUtilization) error {
+	header := []string{"Name", "ContainerID", "MemoryLimit", "PeakMemory", "MemoryRatio", "AllocatedCPUs", "MeanCores", "CPURatio"}
+	if err := WriteCSV(filepath.Join(OutputDir(), "task_utilization.csv"), header, []string{
+		u.Name,
+		u.ContainerID,
+		strconv.FormatInt(u.MemoryLimit, 10),
+		fmt.Sprintf("%f", u.PeakMemory),
+		fmt.Sprintf("%f", u.MemoryRatio),
+		fmt.Sprintf("%f", u.AllocatedCPUs),
+		fmt.Sprintf("%f", u.MeanCores),
+		fmt.Sprintf("%f", u.CPURatio),
+	}); err != nil {
+		logrus.Error("Error writing utilization to CSV")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func samples(values ...float64) *model.SampleStream {
+	s := &model.SampleStream{}
+	for i, value := range values {
+		s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(value)})
+	}
+	return s
+}
+
+func TestMeanRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix model.Matrix
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"single sample", model.Matrix{samples(5)}, 0},
+		{"steady", model.Matrix{samples(0, 2, 4, 6)}, 2},
+		{"counter reset", model.Matrix{samples(10, 12, 1, 3)}, (2 + 1 + 2) / 3.0},
+		{"series summed", model.Matrix{samples(0, 1, 2), samples(0, 3, 6)}, 4},
+		{"short series ignored", model.Matrix{samples(0, 1, 2), samples(7)}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := meanRate(test.matrix); math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPeakOfSum(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix model.Matrix
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"single series", model.Matrix{samples(1, 5, 3)}, 5},
+		// The peaks of the series are at different times.
+		{"summed per timestamp", model.Matrix{samples(4, 1, 1), samples(1, 1, 4)}, 5},
+		{"series of different length", model.Matrix{samples(1, 2, 3), samples(6)}, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := peakOfSum(test.matrix); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestComputeUtilizationRatios(t *testing.T) {
+	u := ComputeUtilization("task", "id", model.Matrix{samples(50, 100)}, model.Matrix{samples(0, 1)}, 200, 2)
+	if u.MemoryRatio != 0.5 || u.CPURatio != 0.5 {
+		t.Errorf("got ratios %v and %v, want 0.5", u.MemoryRatio, u.CPURatio)
+	}
+	// Unlimited containers keep the ratios at zero.
+	u = ComputeUtilization("task", "id", model.Matrix{samples(50, 100)}, model.Matrix{samples(0, 1)}, 0, 0)
+	if u.MemoryRatio != 0 || u.CPURatio != 0 {
+		t.Errorf("got ratios %v and %v for an unlimited container, want 0", u.MemoryRatio, u.CPURatio)
+	}
+}
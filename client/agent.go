@@ -0,0 +1,360 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent configures a worker that forwards its container events to the controller.
+type Agent struct {
+	// Address stamped on every event. Detected from the route to the
+	// controller when empty.
+	WorkerIP string `yaml:"worker_ip"`
+	// host:port or unix:<path> of the controller. Derived from the controller
+	// address and the listen section when empty.
+	ControllerAddress string `yaml:"controller_address"`
+	// host:port serving the agent's own metrics, disabled when empty.
+	MetricsAddress string `yaml:"metrics_address"`
+}
+
+// Directories holding the persistent agent state and undelivered events.
+const (
+	agentStateDir = "agent_state"
+	agentSpoolDir = "agent_state/spool"
+)
+
+// Bounds of the exponential backoff between failed deliveries.
+const (
+	agentMinBackoff = 1 * time.Second
+	agentMaxBackoff = 1 * time.Minute
+)
+
+// RunAgent watches the local Docker daemon and streams STARTED and DIED events
+// to the controller, which does all querying and writes the task output.
+// Docker stats and the container event log are only available on the worker
+// and are written to its local results directory. Once the
+// context is cancelled it keeps delivering spooled events until the drain
+// deadline, the rest stays in the spool for the next start.
+func RunAgent(ctx context.Context, config *Config) {
+	network, controllerAddress := ControllerAddress(config)
+	workerIP := config.Agent.WorkerIP
+	if workerIP == "" && network == "unix" {
+		// Agent and controller share the node.
+		workerIP = config.ServerConfigurations.Prometheus.TargetServer.Controller
+	}
+	if workerIP == "" {
+		detected, err := detectWorkerIP(controllerAddress)
+		if err != nil {
+			logrus.Error("Error detecting worker IP, please set agent.worker_ip: ", err)
+			return
+		}
+		workerIP = detected
+	}
+	logrus.Infof("[AGENT] Forwarding container events of worker %s to %s %s", workerIP, network, controllerAddress)
+
+	store, err := watcher.OpenStateStore(agentStateDir)
+	if err != nil {
+		logrus.Error("Error opening state store: ", err)
+		return
+	}
+	defer store.Close()
+	lifecycle := watcher.NewLifecycle(store)
+
+	// Events go through the spool so they survive an unreachable controller
+	// and agent restarts.
+	spool, err := OpenSpool(agentSpoolDir)
+	if err != nil {
+		logrus.Error("Error opening spool: ", err)
+		return
+	}
+	defer spool.Close()
+
+	// Docker stats and lifecycle events stay in the worker's results directory.
+	if err := configureOutputFiles(ctx, config); err != nil {
+		logrus.Error("Error configuring output: ", err)
+		return
+	}
+	defer func() {
+		if err := aggregate.OutputFiles.Close(); err != nil {
+			logrus.Error("Error closing output: ", err)
+		}
+	}()
+
+	registerQueueDepth("spool", spool.Len)
+	ServeMetrics(ctx, config.Agent.MetricsAddress)
+
+	tlsConfig, err := config.Security.ClientTLSConfig()
+	if err != nil {
+		logrus.Error("Error configuring TLS: ", err)
+		return
+	}
+	// Delivery outlives the context to drain the spool on shutdown.
+	sendCtx, stopSending := context.WithCancel(context.Background())
+	sender := NewEventSender(network, controllerAddress, tlsConfig, config.Security.Secret())
+	defer sender.Close()
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		sender.Drain(sendCtx, spool)
+	}()
+	defer func() {
+		stopSending()
+		<-senderDone
+	}()
+
+	// Heartbeats use their own connection so they are not stuck behind a
+	// backlog of spooled events.
+	heartbeatSender := NewEventSender(network, controllerAddress, tlsConfig, config.Security.Secret())
+	var heartbeats sync.WaitGroup
+	heartbeats.Add(1)
+	go func() {
+		defer heartbeats.Done()
+		heartbeatSender.SendHeartbeats(ctx, workerIP, config.Heartbeat.IntervalDuration(), sender, spool)
+	}()
+	defer func() {
+		heartbeats.Wait()
+		heartbeatSender.Close()
+	}()
+
+	events := make(chan watcher.NextflowContainer)
+	opts := watcher.WatchOptions{
+		Metadata: config.ContainerMetadata.Options(),
+		WorkerIP: workerIP,
+	}
+	workflowContainer := watcher.NextflowContainer{}
+	go workflowContainer.GetContainerEvents(ctx, opts, lifecycle, events)
+
+	for container := range events {
+		eventsReceived.WithLabelValues(eventType(container), workerIP).Inc()
+		envelope, err := protocol.NewEnvelope(protocol.TypeContainerEvent, EventID(container), container)
+		if err != nil {
+			logrus.Errorf("[AGENT] Error encoding %s event of %s: %v", container.ContainerEvent, container.Name, err)
+			eventsDropped.WithLabelValues("encoding").Inc()
+			continue
+		}
+		if err := spool.Append(envelope); errors.Is(err, protocol.ErrTooLarge) {
+			logrus.Errorf("[AGENT] Dropping %s event of %s: %v", container.ContainerEvent, container.Name, err)
+			eventsDropped.WithLabelValues("oversized").Inc()
+		} else if err != nil {
+			logrus.Errorf("[AGENT] Error spooling %s event of %s: %v", container.ContainerEvent, container.Name, err)
+			eventsDropped.WithLabelValues("spool").Inc()
+			continue
+		}
+		// Once spooled the agent is done with a dead container.
+		if container.ContainerEvent == "[DIED]" {
+			lifecycle.Finish(container)
+		}
+	}
+
+	drainSpool(spool, config.Shutdown.DrainTimeoutDuration())
+}
+
+// drainSpool waits for the sender to deliver the spooled events.
+func drainSpool(spool *Spool, timeout time.Duration) {
+	if spool.Len() == 0 {
+		return
+	}
+	logrus.Infof("[AGENT] Shutting down, delivering %d spooled events for up to %v", spool.Len(), timeout)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for spool.Len() > 0 {
+		select {
+		case <-deadline:
+			logrus.Warnf("[AGENT] Drain deadline passed, %d events are left in the spool for the next start", spool.Len())
+			return
+		case <-ticker.C:
+		}
+	}
+	logrus.Info("[AGENT] Delivered all spooled events")
+}
+
+// ControllerAddress returns the network and address agents send their events to.
+func ControllerAddress(c *Config) (string, string) {
+	if address := c.Agent.ControllerAddress; address != "" {
+		if path, ok := strings.CutPrefix(address, "unix:"); ok {
+			return "unix", path
+		}
+		return "tcp", address
+	}
+	if c.Listen.UnixSocket != "" {
+		return "unix", c.Listen.UnixSocket
+	}
+
+	// The listen host is usually a wildcard, so only take over its port.
+	port := strconv.Itoa(defaultEventPort)
+	if c.Listen.Address != "" {
+		if _, listenPort, err := net.SplitHostPort(c.Listen.Address); err == nil {
+			port = listenPort
+		}
+	}
+	return "tcp", net.JoinHostPort(c.ServerConfigurations.Prometheus.TargetServer.Controller, port)
+}
+
+// detectWorkerIP returns the local address used to reach the controller.
+func detectWorkerIP(controllerAddress string) (string, error) {
+	conn, err := net.Dial("udp", controllerAddress)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// EventSender delivers container events over a single long-lived connection,
+// reconnecting whenever it breaks.
+type EventSender struct {
+	sent      atomic.Int64 // Events acknowledged by the controller.
+	network   string
+	address   string
+	tlsConfig *tls.Config // Plain TCP when nil.
+	secret    []byte      // Signs every envelope when set.
+	mu        sync.Mutex  // Guards conn, held for a whole exchange.
+	conn      *protocol.Conn
+}
+
+func NewEventSender(network, address string, tlsConfig *tls.Config, secret []byte) *EventSender {
+	return &EventSender{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		secret:    secret,
+	}
+}
+
+// EventID identifies an event by container ID, event type and the time it
+// happened, so the controller can drop re-sent events while a restarted
+// container still gets a new ID.
+func EventID(container watcher.NextflowContainer) string {
+	eventTime := container.StartTime
+	if container.ContainerEvent == "[DIED]" {
+		eventTime = container.DieTime
+	}
+	return fmt.Sprintf("%s/%s/%d", container.ContainerID, eventType(container), eventTime.UnixNano())
+}
+
+// Drain delivers the spooled envelopes in order until the context is
+// cancelled. Connection failures and NACKs are retried with exponential
+// backoff, envelopes that are too large or answered with an error are dropped
+// since retrying them cannot succeed.
+func (s *EventSender) Drain(ctx context.Context, spool *Spool) {
+	backoff := agentMinBackoff
+	for {
+		envelope, err := spool.Next(ctx)
+		if err != nil {
+			return
+		}
+		response, err := s.send(envelope)
+		switch {
+		case errors.Is(err, protocol.ErrTooLarge):
+			// Only the signature can push a spooled envelope over the limit.
+			logrus.Errorf("[AGENT] Dropping event %s: %v", envelope.ID, err)
+			eventsDropped.WithLabelValues("oversized").Inc()
+			if err := spool.Ack(); err != nil {
+				logrus.Error("Error updating spool: ", err)
+			}
+			continue
+		case err != nil:
+			logrus.Warnf("[AGENT] Error sending event to controller, retrying in %v (%d spooled): %v", backoff, spool.Len(), err)
+			eventsSent.WithLabelValues("failed").Inc()
+			s.Close()
+		case response.Status == protocol.StatusNack:
+			logrus.Warnf("[AGENT] Controller rejected event %s, retrying in %v: %s", envelope.ID, backoff, response.Error)
+			eventsSent.WithLabelValues(string(response.Status)).Inc()
+		default:
+			eventsSent.WithLabelValues(string(response.Status)).Inc()
+			if response.Status == protocol.StatusAck {
+				s.sent.Add(1)
+			} else {
+				logrus.Errorf("[AGENT] Dropping event %s: %s", envelope.ID, response.Error)
+				eventsDropped.WithLabelValues("rejected").Inc()
+			}
+			if err := spool.Ack(); err != nil {
+				logrus.Error("Error updating spool: ", err)
+			}
+			backoff = agentMinBackoff
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, agentMaxBackoff)
+	}
+}
+
+// SendHeartbeats reports the agent's liveness and delivery progress until the
+// context is cancelled. Failed heartbeats are not retried, the next one
+// follows soon.
+func (s *EventSender) SendHeartbeats(ctx context.Context, workerIP string, interval time.Duration, events *EventSender, spool *Spool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		heartbeat := protocol.Heartbeat{
+			Worker:     workerIP,
+			Version:    Version,
+			EventsSent: events.sent.Load(),
+			Spooled:    spool.Len(),
+		}
+		envelope, err := protocol.NewEnvelope(protocol.TypeHeartbeat, fmt.Sprintf("%s/heartbeat/%d", workerIP, time.Now().UnixNano()), heartbeat)
+		if err != nil {
+			logrus.Error("Error encoding heartbeat: ", err)
+		} else if _, err := s.send(envelope); err != nil {
+			logrus.Warn("[AGENT] Error sending heartbeat: ", err)
+			s.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *EventSender) send(envelope protocol.Envelope) (protocol.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var conn net.Conn
+		var err error
+		if s.tlsConfig != nil {
+			conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tlsConfig)
+		} else {
+			conn, err = dialer.Dial(s.network, s.address)
+		}
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		s.conn = protocol.NewConn(conn)
+	}
+	if s.secret != nil {
+		envelope.Sign(s.secret)
+	}
+	s.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return s.conn.Send(envelope)
+}
+
+func (s *EventSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+)
+
+// ackServer answers every envelope with an ACK and records the acknowledged
+// IDs.
+func ackServer(t *testing.T) (net.Listener, *sync.Map) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acked sync.Map
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := protocol.NewConn(c)
+				defer conn.Close()
+				for {
+					envelope, err := conn.ReadEnvelope()
+					if err != nil {
+						return
+					}
+					acked.Store(envelope.ID, struct{}{})
+					conn.WriteResponse(protocol.Response{ID: envelope.ID, Status: protocol.StatusAck})
+				}
+			}()
+		}
+	}()
+	return listener, &acked
+}
+
+func TestEventSenderCloseWhileSending(t *testing.T) {
+	listener, acked := ackServer(t)
+	defer listener.Close()
+	spool, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	const events = 200
+	for i := 0; i < events; i++ {
+		envelope, err := protocol.NewEnvelope(protocol.TypeContainerEvent, fmt.Sprintf("event-%d", i), struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := spool.Append(envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sender := NewEventSender("tcp", listener.Addr().String(), nil, []byte("secret"))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sender.SendHeartbeats(ctx, "10.0.0.1", time.Millisecond, sender, spool)
+	}()
+	go func() {
+		defer wg.Done()
+		sender.Drain(ctx, spool)
+	}()
+	// Closing breaks the connection, the next send reconnects.
+	for ctx.Err() == nil {
+		sender.Close()
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender did not return after the context was cancelled")
+	}
+	sender.Close()
+
+	// Every event was either acknowledged or is still spooled.
+	sent := int(sender.sent.Load())
+	if sent+spool.Len() != events {
+		t.Errorf("got %d sent and %d spooled events, want %d in total", sent, spool.Len(), events)
+	}
+	for i := 0; i < sent; i++ {
+		if _, ok := acked.Load(fmt.Sprintf("event-%d", i)); !ok {
+			t.Errorf("event-%d counted as sent without an ACK", i)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// API configures the controller's HTTP status server.
+type API struct {
+	// host:port to serve on, disabled when empty.
+	Address string `yaml:"address"`
+}
+
+// Directory whose files are listed and served by the API.
+const apiResultsDir = "results"
+
+// APIServer exposes the controller's state as JSON.
+type APIServer struct {
+	config     *Config
+	configPath string
+	lifecycle  *watcher.Lifecycle
+	workers    *WorkerRegistry
+	resultsDir string
+}
+
+func NewAPIServer(c *Config, configPath string, lifecycle *watcher.Lifecycle, workers *WorkerRegistry) *APIServer {
+	return &APIServer{
+		config:     c,
+		configPath: configPath,
+		lifecycle:  lifecycle,
+		workers:    workers,
+		resultsDir: apiResultsDir,
+	}
+}
+
+// ServeAPI starts the HTTP server in the background if an address is
+// configured and stops it when the context is cancelled.
+func ServeAPI(ctx context.Context, c *Config, configPath string, lifecycle *watcher.Lifecycle, workers *WorkerRegistry) {
+	if c.API.Address == "" {
+		return
+	}
+	server := NewAPIServer(c, configPath, lifecycle, workers)
+	serveHTTP(ctx, &http.Server{Addr: c.API.Address, Handler: server.Handler()}, "HTTP API")
+}
+
+func (s *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/containers/running", s.handleRunning)
+	mux.HandleFunc("GET /api/containers/died", s.handleDied)
+	mux.HandleFunc("GET /api/queries", s.handleQueries)
+	mux.HandleFunc("GET /api/targets", s.handleTargets)
+	mux.HandleFunc("GET /api/workers", s.handleWorkers)
+	mux.HandleFunc("GET /api/results", s.handleResults)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.Handle("GET /results/", http.StripPrefix("/results/", hideStateFiles(http.FileServer(http.Dir(s.resultsDir)))))
+	return mux
+}
+
+// hideStateFiles keeps the controller's internal state out of the downloads.
+func hideStateFiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logrus.Error("Error writing API response: ", err)
+	}
+}
+
+func (s *APIServer) handleRunning(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.lifecycle.Records(watcher.StateStarted, watcher.StatePaused))
+}
+
+// handleDied lists containers waiting to be processed followed by the most
+// recently processed ones.
+func (s *APIServer) handleDied(w http.ResponseWriter, r *http.Request) {
+	records := s.lifecycle.Records(watcher.StateDied, watcher.StateProcessed)
+	recent := s.lifecycle.Recent()
+	for i := len(recent) - 1; i >= 0; i-- {
+		records = append(records, recent[i])
+	}
+	writeJSON(w, records)
+}
+
+func (s *APIServer) handleQueries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string][]QueryStatus{
+		"pending": queryTracker.Pending(),
+		"failed":  queryTracker.Failed(),
+	})
+}
+
+type targetInfo struct {
+	Target     string   `json:"target"`
+	Source     string   `json:"source"`
+	Name       string   `json:"name"`
+	Query      string   `json:"query"`
+	Labels     []string `json:"labels"`
+	Identifier string   `json:"identifier"`
+	Unit       string   `json:"unit"`
+}
+
+func (s *APIServer) handleTargets(w http.ResponseWriter, r *http.Request) {
+	var targets []targetInfo
+	for target, dataSources := range ConsolidateQueries(ReadMonitoringConfiguration(s.configPath)) {
+		for source, queries := range dataSources {
+			for _, query := range queries {
+				targets = append(targets, targetInfo{
+					Target:     target,
+					Source:     source,
+					Name:       query.V1,
+					Query:      query.V2,
+					Labels:     query.V3,
+					Identifier: query.V4,
+					Unit:       query.V5,
+				})
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Target != targets[j].Target {
+			return targets[i].Target < targets[j].Target
+		}
+		return targets[i].Name < targets[j].Name
+	})
+	writeJSON(w, map[string]any{
+		"prometheus": s.config.ServerConfigurations.Prometheus.TargetServer.Address,
+		"targets":    targets,
+	})
+}
+
+func (s *APIServer) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.workers.Workers())
+}
+
+type resultFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	URL      string    `json:"url"`
+}
+
+// handleResults lists the result files, optionally only those of one task
+// selected with ?task=<container name>.
+func (s *APIServer) handleResults(w http.ResponseWriter, r *http.Request) {
+	task := r.URL.Query().Get("task")
+	files := []resultFile{}
+	err := filepath.WalkDir(s.resultsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Internal state is not a result.
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && path != s.resultsDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.resultsDir, path)
+		if err != nil {
+			return err
+		}
+		if task != "" && !strings.Contains(rel, task) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, resultFile{
+			Path:     rel,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			URL:      "/results/" + (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath(),
+		})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, files)
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+)
+
+func getJSON(t *testing.T, server *httptest.Server, path string, v any) {
+	t.Helper()
+	response, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d", path, response.StatusCode)
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIListsRunningContainers(t *testing.T) {
+	lifecycle := watcher.NewLifecycle(nil)
+	lifecycle.Transition(watcher.StateStarted, watcher.NextflowContainer{ContainerID: "id", Name: "nxf-task", StartTime: time.Unix(100, 0)})
+	api := NewAPIServer(&Config{}, "", lifecycle, NewWorkerRegistry(nil, time.Minute))
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	var running []watcher.ContainerRecord
+	getJSON(t, server, "/api/containers/running", &running)
+	if len(running) != 1 || running[0].Container.Name != "nxf-task" {
+		t.Errorf("got running containers %+v, want nxf-task", running)
+	}
+}
+
+func TestAPIServesResults(t *testing.T) {
+	dir := t.TempDir()
+	for path, data := range map[string]string{
+		"cpu/cadvisor/nxf-a.csv": "a",
+		"cpu/cadvisor/nxf-b.csv": "b",
+		".state/events.log":      "state",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := NewAPIServer(&Config{}, "", watcher.NewLifecycle(nil), NewWorkerRegistry(nil, time.Minute))
+	api.resultsDir = dir
+	server := httptest.NewServer(api.Handler())
+	defer server.Close()
+
+	var files []resultFile
+	getJSON(t, server, "/api/results", &files)
+	if len(files) != 2 {
+		t.Errorf("got files %+v, want the two results without the state", files)
+	}
+	getJSON(t, server, "/api/results?task=nxf-b", &files)
+	if len(files) != 1 || files[0].Path != filepath.Join("cpu", "cadvisor", "nxf-b.csv") {
+		t.Fatalf("got files %+v, want the result of nxf-b", files)
+	}
+
+	response, err := http.Get(server.URL + files[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(data) != "b" {
+		t.Errorf("got %q from %s, want the file content", data, files[0].URL)
+	}
+
+	response, err = http.Get(server.URL + "/results/.state/events.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for the state, want 404", response.StatusCode)
+	}
+}
@@ -1,10 +1,11 @@
 package client
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
@@ -15,6 +16,9 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Directory holding the persistent controller state.
+const stateDir = "results/.state"
+
 // Configurations structures.
 type TargetServer struct {
 	Address       string   `yaml:"address"`
@@ -34,9 +38,115 @@ type ServerConfigurations struct {
 }
 type Config struct {
 	ServerConfigurations ServerConfigurations `yaml:"server_configurations"`
+	Listen               Listen               `yaml:"listen"`
+	Agent                Agent                `yaml:"agent"`
+	Heartbeat            Heartbeat            `yaml:"heartbeat"`
+	API                  API                  `yaml:"api"`
+	Security             Security             `yaml:"security"`
+	ContainerMetadata    ContainerMetadata    `yaml:"container_metadata"`
+	Processing           Processing           `yaml:"processing"`
+	Shutdown             Shutdown             `yaml:"shutdown"`
+	Output               Output               `yaml:"output"`
 	MonitoringTargets    MonitoringTargets    `yaml:"monitoring_targets"`
 }
 
+// Docker labels and environment variables recorded with every task.
+type ContainerMetadata struct {
+	Labels []string `yaml:"labels"`
+	Env    []string `yaml:"env"`
+}
+
+func (m ContainerMetadata) Options() watcher.MetadataOptions {
+	return watcher.MetadataOptions{
+		Labels: m.Labels,
+		Env:    m.Env,
+	}
+}
+
+// Formats the task metrics are written in, e.g. [csv, jsonl].
+type Output struct {
+	Formats []string      `yaml:"formats"`
+	Layout  string        `yaml:"layout"` // CSV layout: shared, task_dir or task_file.
+	Parquet ParquetOutput `yaml:"parquet"`
+	Runs    bool          `yaml:"runs"` // Write every session to results/<run id>.
+
+	// Write all labels returned by Prometheus instead of the configured ones.
+	AllLabels bool `yaml:"all_labels"`
+
+	TimeFormat string `yaml:"time_format"` // rfc3339nano, unix_ms, unix_ns or a Go time layout.
+	Timezone   string `yaml:"timezone"`    // UTC, Local or an IANA name.
+
+	MaxOpenFiles  int    `yaml:"max_open_files"` // CSV files kept open between writes.
+	FlushInterval string `yaml:"flush_interval"` // How often buffered CSV records are written.
+
+	// Compression of the CSV (including lifecycle), JSONL and Docker stats
+	// files: none, gzip or zstd.
+	Compression string    `yaml:"compression"`
+	Rotation    Rotation  `yaml:"rotation"`
+	Retention   Retention `yaml:"retention"`
+}
+
+// Rotation starts a new output file once the current one is too large or
+// too old. Zero values disable the respective rotation.
+type Rotation struct {
+	MaxSizeMB int64  `yaml:"max_size_mb"`
+	Interval  string `yaml:"interval"`
+}
+
+func (r Rotation) Options() aggregate.RotationOptions {
+	return aggregate.RotationOptions{
+		MaxSize:  r.MaxSizeMB * 1024 * 1024,
+		Interval: parseDuration(r.Interval, 0),
+	}
+}
+
+func (o Output) FlushIntervalDuration() time.Duration {
+	return parseDuration(o.FlushInterval, aggregate.DefaultFlushInterval)
+}
+
+type ParquetOutput struct {
+	Partition    string `yaml:"partition"`      // target or run.
+	RowGroupSize int64  `yaml:"row_group_size"` // Rows per row group.
+	Compression  string `yaml:"compression"`    // none, snappy, gzip or zstd.
+	RollTasks    int    `yaml:"roll_tasks"`     // Tasks per file.
+	RollInterval string `yaml:"roll_interval"`  // Maximum age of a file.
+}
+
+// NewSink creates the sink writing the configured formats below dir.
+func (o Output) NewSink(dir string) (aggregate.OutputSink, error) {
+	return aggregate.NewSink(dir, o.Formats, aggregate.SinkOptions{
+		Layout: o.Layout,
+		Parquet: aggregate.ParquetOptions{
+			Partition:    o.Parquet.Partition,
+			RowGroupSize: o.Parquet.RowGroupSize,
+			Compression:  o.Parquet.Compression,
+			RollTasks:    o.Parquet.RollTasks,
+			RollInterval: parseDuration(o.Parquet.RollInterval, 0),
+		},
+	})
+}
+
+// Handling of failed tasks (non-zero exit code or OOM killed).
+const (
+	FailedTasksCollect = "collect" // Collect like any other task (default).
+	FailedTasksSkip    = "skip"    // Do not query Prometheus for failed tasks.
+	FailedTasksTag     = "tag"     // Add a task_status column to the metric output.
+)
+
+type Processing struct {
+	FailedTasks string      `yaml:"failed_tasks"`
+	Utilization Utilization `yaml:"utilization"`
+	Workers     int         `yaml:"workers"`    // Containers processed concurrently.
+	QueueSize   int         `yaml:"queue_size"` // Dead containers waiting for a worker.
+}
+
+// Metric names (as configured under monitoring_targets) used to relate usage
+// to the container's resource limits.
+type Utilization struct {
+	MemoryMetric string `yaml:"memory_metric"`
+	CPUMetric    string `yaml:"cpu_metric"`
+}
+
 type MonitoringTargets struct {
 	TaskMetadata MonitoringTarget `yaml:"task_metadata"`
 	CPU          MonitoringTarget `yaml:"cpu"`
@@ -91,99 +201,83 @@ func NewFetchClient(c *Config) (api.Client, error) {
 	return client, nil
 }
 
-func HandleIdleState(monitorIsIdle *bool) {
+func HandleIdleState(monitorIsIdle *bool, lifecycle *watcher.Lifecycle) {
 	if !*monitorIsIdle {
-		logrus.Info("[WF MONITOR IDLE]")
+		logrus.Infof("[WF MONITOR IDLE] Containers per state: %v", lifecycle.Counts())
 		*monitorIsIdle = true
 	}
 }
 
-func CreateTCPListener(controllerIP string) (*net.TCPListener, error) {
-	ip := net.ParseIP(controllerIP)
-	if ip == nil {
-		logrus.Errorf("Invalid IP address: %s", controllerIP)
-		return nil, fmt.Errorf("invalid IP address: %s", controllerIP)
-	}
-
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   ip,
-		Port: 42,
-	})
-	if err != nil {
-		logrus.Errorf("Error creating TCP listener on %s:%d:", controllerIP, err)
-		return nil, err
-	}
+// Serializes the lifecycle output of the local watcher and the agent connections.
+var lifecycleOutputMu sync.Mutex
 
-	logrus.Infof("Listening for container events on %s", listener.Addr())
-	return listener, nil
-}
+// Returned for remote die events while the processing queue is full, so the
+// agent retries instead of blocking its connection.
+var errQueueFull = errors.New("processing queue is full")
 
-func ListenForContainerEvents(c *Config, configPath string, containerEventChannel chan<- watcher.NextflowContainer) {
-	// Create the TCP listener using the helper function.
-	listener, err := CreateTCPListener(c.ServerConfigurations.Prometheus.TargetServer.Controller)
-	if err != nil {
-		return
+// DispatchContainerEvent writes the lifecycle output of a local container and
+// hands dead containers over to the monitoring logic.
+func DispatchContainerEvent(container watcher.NextflowContainer, metadata watcher.MetadataOptions, containerEventChannel chan<- watcher.NextflowContainer) {
+	writeLifecycleOutput(container, metadata)
+	if container.ContainerEvent == "[DIED]" {
+		containerEventChannel <- container // Forward the container event to the monitoring logic.
 	}
-
-	// Run the listener in a goroutine to keep it active.
-	go func(listener *net.TCPListener) {
-		defer listener.Close() // Ensure the listener is closed when the goroutine exits.
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				logrus.Errorf("Error accepting connection: %v", err)
-				continue
-			}
-			logrus.Infof("Accepted connection from %s", conn.RemoteAddr())
-
-			// Handle the connection in a separate goroutine.
-			go HandleIncomingContainerEvents(conn, containerEventChannel)
-		}
-	}(listener)
 }
 
-func HandleIncomingContainerEvents(con net.Conn, containerEventChannel chan<- watcher.NextflowContainer) {
-	defer con.Close()
-
-	// Read the incoming data from the connection.
-	buffer := make([]byte, 1024)
-	n, err := con.Read(buffer)
-	if err != nil {
-		logrus.Error("Error reading from connection: ", err)
-		return
-	}
-
-	// Deserialize the incoming data into a NextflowContainer.
-	var container watcher.NextflowContainer
-	err = json.Unmarshal(buffer[:n], &container)
-	if err != nil {
-		logrus.Error("Error deserializing container data: ", err)
-		return
-	}
-
-	// Handle the event based on its type.
+// writeLifecycleOutput writes the started or died record of a container.
+func writeLifecycleOutput(container watcher.NextflowContainer, metadata watcher.MetadataOptions) {
+	lifecycleOutputMu.Lock()
+	defer lifecycleOutputMu.Unlock()
 	switch container.ContainerEvent {
 	case "[STARTED]":
-		logrus.Infof("[REMOTE START EVENT] Writing container %s to output.", container.Name)
-		// watcher.WriteToOutput(container) // Write the container data to output.
-		watcher.WriteStartedToOutput(container) // Write the container data to output.
+		watcher.WriteStartedToOutput(container, metadata) // Write the container data to output.
 	case "[DIED]":
-		logrus.Info("[REMOTE DIE EVENT] Writing container to output and monitoring channel.", container)
-		containerEventChannel <- container   // Forward the container event to the monitoring logic.
-		watcher.WriteDiedToOutput(container) // Write the container data to output.
+		watcher.WriteDiedToOutput(container, metadata) // Write the container data to output.
 	}
 }
 
-func WatchContainerEvents(containerEventChannel chan<- watcher.NextflowContainer) {
+// WatchContainerEvents forwards the local container events until the context
+// is cancelled. The returned channel is closed once the last event was handed
+// over.
+func WatchContainerEvents(ctx context.Context, c *Config, lifecycle *watcher.Lifecycle, containerEventChannel chan<- watcher.NextflowContainer) <-chan struct{} {
 	workflowContainer := watcher.NextflowContainer{}
-	go workflowContainer.GetContainerEvents(containerEventChannel)
+	opts := watcher.WatchOptions{
+		Metadata: c.ContainerMetadata.Options(),
+		WorkerIP: c.ServerConfigurations.Prometheus.TargetServer.Controller,
+	}
+	localEvents := make(chan watcher.NextflowContainer)
+	done := make(chan struct{})
+	go workflowContainer.GetContainerEvents(ctx, opts, lifecycle, localEvents)
+	go func() {
+		defer close(done)
+		for container := range localEvents {
+			eventsReceived.WithLabelValues(eventType(container), opts.WorkerIP).Inc()
+			DispatchContainerEvent(container, opts.Metadata, containerEventChannel)
+		}
+	}()
+	return done
+}
+
+// ResumePendingContainers re-queues containers that died before a restart but
+// whose results were never written.
+func ResumePendingContainers(lifecycle *watcher.Lifecycle, containerEventChannel chan<- watcher.NextflowContainer) {
+	pending := lifecycle.Containers(watcher.StateDied)
+	if len(pending) == 0 {
+		return
+	}
+	logrus.Infof("Resuming %d dead containers from the previous run", len(pending))
+	go func() {
+		for _, container := range pending {
+			containerEventChannel <- container
+		}
+	}()
 }
 
 // Refactor to pass a nxf container object
-func StartMonitoring(c *Config, cfp string, workflowContainer watcher.NextflowContainer) (map[string]map[string]map[string]model.Matrix, map[string][]string, map[string]map[string]string, error) {
+func StartMonitoring(ctx context.Context, c *Config, cfp string, workflowContainer watcher.NextflowContainer) (map[string]map[string]map[string]model.Matrix, map[string][]string, map[string]map[string]string, error) {
 	queriesMap := ConsolidateQueries(ReadMonitoringConfiguration(cfp)) // Ignore labels
 
-	resultMap, QueryMetaInfo, QueryUnitInfo, err := FetchMonitoringSources(c, workflowContainer, queriesMap)
+	resultMap, QueryMetaInfo, QueryUnitInfo, err := FetchMonitoringSources(ctx, c, workflowContainer, queriesMap)
 	if err != nil {
 		logrus.Error("Error fetching queries: ", err)
 		return resultMap, QueryMetaInfo, QueryUnitInfo, err
@@ -191,56 +285,243 @@ func StartMonitoring(c *Config, cfp string, workflowContainer watcher.NextflowCo
 	return resultMap, QueryMetaInfo, QueryUnitInfo, err
 }
 
-func ScheduleMonitoring(config *Config, configPath string) {
+// configureOutputFiles applies the output settings shared by the controller
+// and the agents, which write Docker stats and lifecycle events locally.
+func configureOutputFiles(ctx context.Context, config *Config) error {
+	if err := aggregate.SetTimeFormat(config.Output.TimeFormat, config.Output.Timezone); err != nil {
+		return err
+	}
+	if err := aggregate.OutputFiles.SetCompression(config.Output.Compression); err != nil {
+		return err
+	}
+	aggregate.OutputFiles.SetRotation(config.Output.Rotation.Options())
+	aggregate.OutputFiles.SetMaxOpenFiles(config.Output.MaxOpenFiles)
+	go aggregate.OutputFiles.FlushPeriodically(ctx, config.Output.FlushIntervalDuration())
+	return nil
+}
+
+// ScheduleMonitoring runs the controller until the context is cancelled, then
+// drains the queued dead containers.
+func ScheduleMonitoring(ctx context.Context, config *Config, configPath string) {
 	monitorIsIdle := false
 
-	// Init the event-based polling for container events.
-	containerEventChannel := make(chan watcher.NextflowContainer)
+	// Open the on-disk state so a restart does not lose unfinished containers.
+	store, err := watcher.OpenStateStore(stateDir)
+	if err != nil {
+		logrus.Error("Error opening state store: ", err)
+		return
+	}
+	defer store.Close()
+	lifecycle := watcher.NewLifecycle(store)
+
+	if err := configureOutputFiles(ctx, config); err != nil {
+		logrus.Error("Error configuring output: ", err)
+		return
+	}
+
+	// Each session may get its own directory with a manifest.
+	run, err := StartRun(config, configPath)
+	if err != nil {
+		logrus.Error("Error starting run: ", err)
+		return
+	}
+
+	// Results go to the configured output formats.
+	sink, err := config.Output.NewSink(run.OutputDir())
+	if err != nil {
+		logrus.Error("Error creating output: ", err)
+		return
+	}
+	go EnforceRetention(ctx, config.Output.Retention, aggregate.DefaultOutputDir, run.OutputDir())
+
+	// Dead containers are queued for a pool of workers.
+	pool := NewProcessingPool(config, configPath, lifecycle, sink)
+	containerEventChannel := pool.Queue()
+
+	// Finish containers left over from before a restart.
+	ResumePendingContainers(lifecycle, containerEventChannel)
+
+	// Track the liveness of the workers sending remote events.
+	workers := NewWorkerRegistry(config.ServerConfigurations.Prometheus.TargetServer.Workers, config.Heartbeat.TimeoutDuration())
+	go workers.Watch(ctx, config.Heartbeat.IntervalDuration())
+
+	// The manifest lists the files once the outputs are complete.
+	defer func() {
+		if err := errors.Join(sink.Close(), aggregate.OutputFiles.Close()); err != nil {
+			logrus.Error("Error closing output: ", err)
+		}
+		run.Finish(workers.Workers())
+	}()
 
 	// Start listening for remote container events.
-	go ListenForContainerEvents(config, configPath, containerEventChannel)
+	go ListenForContainerEvents(ctx, config, configPath, lifecycle, workers, containerEventChannel)
+
+	// Expose the controller's state and metrics over HTTP.
+	registerQueueDepth("containers", func() int { return lifecycle.Counts()[watcher.StateDied] })
+	registerQueueDepth("queries", func() int { return len(queryTracker.Pending()) })
+	registerQueueDepth("processing", pool.Len)
+	registerLifecycleStates(lifecycle)
+	ServeAPI(ctx, config, configPath, lifecycle, workers)
 
 	// Watch local container events.
-	WatchContainerEvents(containerEventChannel)
+	watcherDone := WatchContainerEvents(ctx, config, lifecycle, containerEventChannel)
+
+	// Processing is only cut off once the drain deadline passed after a
+	// shutdown was requested.
+	processCtx, cancelProcessing := context.WithCancel(context.Background())
+	defer cancelProcessing()
+	context.AfterFunc(ctx, func() {
+		time.AfterFunc(config.Shutdown.DrainTimeoutDuration(), cancelProcessing)
+	})
+	pool.Start(processCtx)
 
-	// Run the main monitoring loop by receiving container events.
+	// Report the state whenever the pool runs idle.
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
-		case workflowContainer := <-containerEventChannel:
-			monitorIsIdle = false
-			ProcessContainerEvent(config, configPath, workflowContainer)
-		case <-time.After(10 * time.Second):
-			HandleIdleState(&monitorIsIdle)
+		case <-ctx.Done():
+			DrainContainerEvents(processCtx, config, lifecycle, pool, watcherDone)
+			cancelProcessing()
+			pool.Wait()
+			return
+		case <-ticker.C:
+			if pool.Idle() {
+				HandleIdleState(&monitorIsIdle, lifecycle)
+			} else {
+				monitorIsIdle = false
+			}
 		}
 	}
 }
 
-func ProcessContainerEvent(config *Config, configPath string, workflowContainer watcher.NextflowContainer) {
+// ProcessContainerEvent queries and writes the metrics of a dead container.
+// Containers whose queries were cancelled stay pending for the next start.
+func ProcessContainerEvent(ctx context.Context, config *Config, configPath string, lifecycle *watcher.Lifecycle, sink aggregate.OutputSink, workflowContainer watcher.NextflowContainer) error {
 	logrus.Infof("[RECEIVED DEAD CONTAINER] Container Name coming from channel: %s who lived for %v and has PID %v.", workflowContainer.Name, workflowContainer.LifeTime, workflowContainer.PID)
 
+	// Attach the lifecycle events so gaps or abrupt ends can be explained.
+	watcher.WriteTaskEventsToOutput(workflowContainer)
+
+	var taskStatus string
+	switch config.Processing.FailedTasks {
+	case FailedTasksSkip:
+		if workflowContainer.Failed() {
+			logrus.Warnf("Skipping metrics of failed task %s (%s)", workflowContainer.Name, workflowContainer.Status())
+			lifecycle.Finish(workflowContainer)
+			return nil
+		}
+	case FailedTasksTag:
+		taskStatus = workflowContainer.Status()
+	}
+
 	// Run the Monitor against Prometheus.
-	resultMap, queryMetaInfo, queryUnitInfo, err := StartMonitoring(config, configPath, workflowContainer)
+	resultMap, queryMetaInfo, queryUnitInfo, err := StartMonitoring(ctx, config, configPath, workflowContainer)
 	if err != nil {
-		logrus.Error("Error starting monitoring: ", err)
-		panic(err)
+		return fmt.Errorf("monitoring interrupted, leaving it for the next start: %w", err)
 	}
 	logrus.Infof("Units: %v", queryUnitInfo)
 
-	// Process results.
+	// Hand the results to the configured output sinks.
+	task := newTaskInfo(workflowContainer, taskStatus)
+	if err := sink.BeginTask(task); err != nil {
+		logrus.Error("Error creating output: ", err)
+	}
 	for target, dataSources := range resultMap {
 		for dataSource, queryNames := range dataSources {
 			for queryName, samples := range queryNames {
-				dataWrapper := aggregate.NewDataVectorWrapper(map[string]map[string]map[string]model.Matrix{
-					target: {
-						dataSource: {
-							queryName: samples,
-						},
-					},
-				}, queryMetaInfo, queryUnitInfo)
-				if err := dataWrapper.CreateDataOutput(); err != nil {
+				labelNames := queryMetaInfo[dataSource]
+				if config.Output.AllLabels {
+					labelNames = aggregate.ReturnedLabelNames(samples)
+				}
+				series := aggregate.Series{
+					Target:     target,
+					Source:     dataSource,
+					Query:      queryName,
+					Unit:       queryUnitInfo[dataSource][queryName],
+					LabelNames: labelNames,
+					Samples:    samples,
+				}
+				if err := sink.WriteSeries(task, series); err != nil {
 					logrus.Error("Error creating output: ", err)
 				}
 			}
 		}
 	}
+	if err := sink.EndTask(task); err != nil {
+		logrus.Error("Error creating output: ", err)
+	}
+
+	WriteTaskUtilization(config, workflowContainer, resultMap)
+
+	if !workflowContainer.DieTime.IsZero() {
+		processingLatency.Observe(time.Since(workflowContainer.DieTime).Seconds())
+	}
+	lifecycle.Finish(workflowContainer)
+	return nil
+}
+
+// newTaskInfo describes the container to the output sinks.
+func newTaskInfo(workflowContainer watcher.NextflowContainer, taskStatus string) aggregate.TaskInfo {
+	task := aggregate.TaskInfo{
+		Name:          workflowContainer.Name,
+		ContainerID:   workflowContainer.ContainerID,
+		WorkerIP:      workflowContainer.WorkerIP,
+		StartTime:     workflowContainer.StartTime,
+		DieTime:       workflowContainer.DieTime,
+		Status:        taskStatus,
+		WorkDir:       workflowContainer.WorkDir,
+		Image:         workflowContainer.Image,
+		ExitStatus:    workflowContainer.Status(),
+		ExitCode:      workflowContainer.ExitCode,
+		OOMKilled:     workflowContainer.OOMKilled,
+		AllocatedCPUs: workflowContainer.Limits.AllocatedCPUs(),
+		MemoryLimit:   workflowContainer.Limits.Memory,
+	}
+	for _, event := range workflowContainer.Events {
+		task.Events = append(task.Events, aggregate.TaskEvent{
+			Time:     event.Time,
+			Action:   event.Action,
+			Signal:   event.Signal,
+			ExitCode: event.ExitCode,
+		})
+	}
+	return task
+}
+
+// WriteTaskUtilization relates the task's peak memory and mean core usage to
+// the limits Docker enforced on its container.
+func WriteTaskUtilization(config *Config, workflowContainer watcher.NextflowContainer, resultMap map[string]map[string]map[string]model.Matrix) {
+	memoryMetric := config.Processing.Utilization.MemoryMetric
+	if memoryMetric == "" {
+		memoryMetric = "container_memory_usage_bytes"
+	}
+	cpuMetric := config.Processing.Utilization.CPUMetric
+	if cpuMetric == "" {
+		cpuMetric = "container_cpu_usage_seconds_total"
+	}
+
+	utilization := aggregate.ComputeUtilization(
+		workflowContainer.Name,
+		workflowContainer.ContainerID,
+		findQueryResult(resultMap, memoryMetric),
+		findQueryResult(resultMap, cpuMetric),
+		workflowContainer.Limits.Memory,
+		workflowContainer.Limits.AllocatedCPUs(),
+	)
+	if err := aggregate.WriteUtilizationToOutput(utilization); err != nil {
+		logrus.Error("Error writing utilization: ", err)
+	}
+}
+
+// findQueryResult looks up the samples of a query by its configured name.
+func findQueryResult(resultMap map[string]map[string]map[string]model.Matrix, queryName string) model.Matrix {
+	for _, dataSources := range resultMap {
+		for _, queryNames := range dataSources {
+			if samples, ok := queryNames[queryName]; ok {
+				return samples
+			}
+		}
+	}
+	return nil
 }
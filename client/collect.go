@@ -16,12 +16,12 @@ import (
 )
 
 // Using Prometheus API to fetch the monitoring targets.
-func FetchMonitoringTargets(client api.Client, queryIdentifier, query string, workflowContainer watcher.NextflowContainer) (model.Matrix, error) {
+func FetchMonitoringTargets(ctx context.Context, client api.Client, queryIdentifier, query string, workflowContainer watcher.NextflowContainer) (model.Matrix, error) {
 	v1api := v1.NewAPI(client)
 	jobQuery := BuildQueryByLabelSelector(query, queryIdentifier, workflowContainer)
 	logrus.Info("Querying Prometheus: ", jobQuery)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	// Perform range query
@@ -53,7 +53,8 @@ func FetchMonitoringTargets(client api.Client, queryIdentifier, query string, wo
 }
 
 // Function to take in client configuration and queries to fetch monitoring targets in a thread.
-func FetchMonitoringSources(c *Config, workflowContainer watcher.NextflowContainer, queriesMap map[string]map[string][]tuple.T5[string, string, []string, string, string]) (map[string]map[string]map[string]model.Matrix, map[string][]string, map[string]map[string]string, error) {
+// It fails when the context was cancelled before all queries finished.
+func FetchMonitoringSources(ctx context.Context, c *Config, workflowContainer watcher.NextflowContainer, queriesMap map[string]map[string][]tuple.T5[string, string, []string, string, string]) (map[string]map[string]map[string]model.Matrix, map[string][]string, map[string]map[string]string, error) {
 	resultsWithCategories := make(map[string]map[string]map[string]model.Matrix)
 	queryMetaInfo := make(map[string][]string)
 	queryUnitInfo := make(map[string]map[string]string)
@@ -73,19 +74,23 @@ func FetchMonitoringSources(c *Config, workflowContainer watcher.NextflowContain
 					queryUnitInfo[dataSource][query.V1] = query.V5
 				}
 			}
+			if len(queryList) > 0 && workflowContainer.PID == 0 && requiresPID(queryList[0].V4) {
+				logrus.Warnf("Skipping %s queries of %s, the PID of container %s is unknown", dataSource, target, workflowContainer.Name)
+				continue
+			}
 			for _, query := range queryList {
 				wg.Add(1)
 
 				queryIdentifier := queryList[0].V4
-				go fetchQuery(c, target, dataSource, queryIdentifier, query, workflowContainer, resultsWithCategories, &mu, &wg)
+				go fetchQuery(ctx, c, target, dataSource, queryIdentifier, query, workflowContainer, resultsWithCategories, &mu, &wg)
 			}
 		}
 	}
 	wg.Wait()
-	return resultsWithCategories, queryMetaInfo, queryUnitInfo, nil
+	return resultsWithCategories, queryMetaInfo, queryUnitInfo, ctx.Err()
 }
 
-func fetchQuery(c *Config, target, dataSource, queryIdentifier string, query tuple.T5[string, string, []string, string, string], workflowContainer watcher.NextflowContainer, mapTargetSourceName map[string]map[string]map[string]model.Matrix, mu *sync.Mutex, wg *sync.WaitGroup) {
+func fetchQuery(ctx context.Context, c *Config, target, dataSource, queryIdentifier string, query tuple.T5[string, string, []string, string, string], workflowContainer watcher.NextflowContainer, mapTargetSourceName map[string]map[string]map[string]model.Matrix, mu *sync.Mutex, wg *sync.WaitGroup) {
 	defer wg.Done()
 	client, err := NewFetchClient(c)
 	if err != nil {
@@ -93,9 +98,22 @@ func fetchQuery(c *Config, target, dataSource, queryIdentifier string, query tup
 		return
 	}
 
+	status := QueryStatus{
+		Container: workflowContainer.Name,
+		Target:    target,
+		Source:    dataSource,
+		Name:      query.V1,
+		Query:     BuildQueryByLabelSelector(query.V2, queryIdentifier, workflowContainer),
+	}
+	queryTracker.Start(status)
+	started := time.Now()
+
 	// Insert the range for the query by event in the container engine.
-	fetcher, err := FetchMonitoringTargets(client, queryIdentifier, query.V2, workflowContainer)
+	fetcher, err := FetchMonitoringTargets(ctx, client, queryIdentifier, query.V2, workflowContainer)
+	queryTracker.Done(status, err)
+	queryDuration.WithLabelValues(dataSource, query.V1).Observe(time.Since(started).Seconds())
 	if err != nil {
+		queryErrors.WithLabelValues(dataSource, query.V1).Inc()
 		logrus.Error("Error fetching monitoring targets", err)
 		return
 	}
@@ -116,6 +134,12 @@ func fetchQuery(c *Config, target, dataSource, queryIdentifier string, query tup
 	}
 }
 
+// requiresPID reports whether the identifier selects series by the container's
+// PID, which is unknown for containers that died before they were inspected.
+func requiresPID(queryIdentifier string) bool {
+	return queryIdentifier == "groupname"
+}
+
 // Dynamically format the PromQL query based on the available identifiers.
 func BuildQueryByLabelSelector(query, queryIdentifier string, workflowContainer watcher.NextflowContainer) string {
 	switch queryIdentifier {
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/barweiss/go-tuple"
+)
+
+func TestFetchWithoutPIDSkipsOnlyPIDQueries(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		queries = append(queries, r.Form.Get("query"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer server.Close()
+
+	config := &Config{}
+	config.ServerConfigurations.Prometheus.TargetServer.Address = server.URL
+	queriesMap := map[string]map[string][]tuple.T5[string, string, []string, string, string]{
+		"cpu": {
+			"cAdvisor": {tuple.New5("cpu", "container_cpu_usage_seconds_total", []string{"name"}, "name", "seconds")},
+			"ebpf":     {tuple.New5("cycles", "process_cycles", []string{"groupname"}, "groupname", "")},
+		},
+	}
+	container := watcher.NextflowContainer{Name: "nxf-task", StartTime: time.Unix(100, 0), DieTime: time.Unix(200, 0)}
+
+	results, _, _, err := FetchMonitoringSources(context.Background(), config, container, queriesMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || queries[0] != `container_cpu_usage_seconds_total{name="nxf-task"}` {
+		t.Errorf("got queries %q, want only the name-based one", queries)
+	}
+	if _, ok := results["cpu"]["cAdvisor"]["cpu"]; !ok {
+		t.Errorf("got results %v, want the cAdvisor query", results)
+	}
+	if _, ok := results["cpu"]["ebpf"]; ok {
+		t.Error("a PID-based query ran for a container without PID")
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import "sync"
+
+// Number of recent event IDs remembered by the controller.
+const dedupCapacity = 10000
+
+// eventDeduplicator remembers the IDs of recently handled events so events an
+// agent re-sends from its spool are acknowledged without being handled twice.
+type eventDeduplicator struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+	ring []string
+	next int
+}
+
+func newEventDeduplicator() *eventDeduplicator {
+	return &eventDeduplicator{
+		seen: make(map[string]struct{}),
+		ring: make([]string, dedupCapacity),
+	}
+}
+
+func (d *eventDeduplicator) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.seen[id]
+	return ok
+}
+
+// Add remembers the ID, forgetting the oldest one once the capacity is reached.
+func (d *eventDeduplicator) Add(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[id]; ok {
+		return
+	}
+	if oldest := d.ring[d.next]; oldest != "" {
+		delete(d.seen, oldest)
+	}
+	d.ring[d.next] = id
+	d.seen[id] = struct{}{}
+	d.next = (d.next + 1) % len(d.ring)
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Port the controller listens on for agent events unless configured otherwise.
+const defaultEventPort = 42
+
+// Listen configures where the controller accepts agent connections.
+type Listen struct {
+	// host:port to listen on. Hosts may be names, IPv4 or bracketed IPv6
+	// addresses, or empty / 0.0.0.0 for all interfaces. Defaults to the
+	// controller address on port 42.
+	Address string `yaml:"address"`
+	// Unix domain socket used instead of TCP for single-node setups.
+	UnixSocket string `yaml:"unix_socket"`
+}
+
+// ListenAddress returns the network and address the controller listens on.
+func ListenAddress(c *Config) (string, string) {
+	if c.Listen.UnixSocket != "" {
+		return "unix", c.Listen.UnixSocket
+	}
+	if c.Listen.Address != "" {
+		return "tcp", c.Listen.Address
+	}
+	return "tcp", net.JoinHostPort(c.ServerConfigurations.Prometheus.TargetServer.Controller, strconv.Itoa(defaultEventPort))
+}
+
+// CreateListener opens the TCP or Unix socket the controller receives agent
+// events on.
+func CreateListener(c *Config) (net.Listener, error) {
+	network, address := ListenAddress(c)
+	if network == "unix" {
+		// Remove a socket left behind by a previous run.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Error removing stale socket %s: %v", address, err)
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		logrus.Errorf("Error creating %s listener on %s: %v", network, address, err)
+		return nil, err
+	}
+
+	logrus.Infof("Listening for container events on %s", listener.Addr())
+	return listener, nil
+}
+
+// ListenForContainerEvents accepts agent connections until the context is
+// cancelled.
+func ListenForContainerEvents(ctx context.Context, c *Config, configPath string, lifecycle *watcher.Lifecycle, workers *WorkerRegistry, containerEventChannel chan<- watcher.NextflowContainer) {
+	// Create the listener using the helper function.
+	listener, err := CreateListener(c)
+	if err != nil {
+		return
+	}
+
+	tlsConfig, err := c.Security.ServerTLSConfig()
+	if err != nil {
+		logrus.Error("Error configuring TLS: ", err)
+		listener.Close()
+		return
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		logrus.Info("Container event listener requires TLS")
+	}
+
+	receiver := &EventReceiver{
+		Metadata:         c.ContainerMetadata.Options(),
+		Secret:           c.Security.Secret(),
+		AllowList:        newWorkerAllowList(c.Security, c.ServerConfigurations.Prometheus.TargetServer.Workers),
+		Lifecycle:        lifecycle,
+		Workers:          workers,
+		ContainerChannel: containerEventChannel,
+		dedup:            newEventDeduplicator(),
+		ctx:              ctx,
+	}
+
+	// Stop accepting connections on shutdown.
+	context.AfterFunc(ctx, func() { listener.Close() })
+
+	// Run the listener in a goroutine to keep it active.
+	go func(listener net.Listener) {
+		defer listener.Close() // Ensure the listener is closed when the goroutine exits.
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					logrus.Info("Stopped listening for container events")
+					return
+				}
+				logrus.Errorf("Error accepting connection: %v", err)
+				continue
+			}
+			if !receiver.AllowList.Allows(conn.RemoteAddr()) {
+				logrus.Warnf("Rejected connection from unknown worker %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			logrus.Infof("Accepted connection from %s", conn.RemoteAddr())
+
+			// Handle the connection in a separate goroutine.
+			go receiver.HandleIncomingContainerEvents(conn)
+		}
+	}(listener)
+}
+
+// Connections without any message for this long are closed.
+const connectionIdleTimeout = 5 * time.Minute
+
+// EventReceiver handles the connections of agents on the controller.
+type EventReceiver struct {
+	Metadata         watcher.MetadataOptions
+	Secret           []byte // Verifies the HMAC of every envelope when set.
+	AllowList        workerAllowList
+	Lifecycle        *watcher.Lifecycle
+	Workers          *WorkerRegistry
+	ContainerChannel chan<- watcher.NextflowContainer
+	dedup            *eventDeduplicator
+	ctx              context.Context // Container events are NACKed once it is done.
+
+	// Dead containers NACKed for a full queue by envelope ID. They went
+	// through the lifecycle already, so the retry only enqueues them.
+	pendingMu sync.Mutex
+	pending   map[string]watcher.NextflowContainer
+}
+
+// HandleIncomingContainerEvents reads framed envelopes from an agent until it
+// closes the connection and answers each of them with an ACK, NACK or error.
+func (r *EventReceiver) HandleIncomingContainerEvents(con net.Conn) {
+	conn := protocol.NewConn(con)
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(connectionIdleTimeout))
+		envelope, err := conn.ReadEnvelope()
+		var malformed *protocol.MalformedError
+		switch {
+		case errors.As(err, &malformed):
+			logrus.Warnf("Malformed message from %s: %v", conn.RemoteAddr(), err)
+			eventsDropped.WithLabelValues("malformed").Inc()
+			respond(conn, envelope.ID, protocol.StatusError, err)
+			continue
+		case errors.Is(err, protocol.ErrTooLarge):
+			// The rest of the line cannot be skipped, answer and hang up.
+			logrus.Warnf("Oversized message from %s: %v", conn.RemoteAddr(), err)
+			eventsDropped.WithLabelValues("oversized").Inc()
+			respond(conn, "", protocol.StatusError, err)
+			return
+		case protocol.IsClosed(err):
+			return
+		case err != nil:
+			logrus.Errorf("Error reading from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if err := envelope.Validate(); err != nil {
+			eventsDropped.WithLabelValues("invalid").Inc()
+			respond(conn, envelope.ID, protocol.StatusError, err)
+			continue
+		}
+		if r.Secret != nil {
+			if err := envelope.Verify(r.Secret); err != nil {
+				logrus.Warnf("Rejected message %s from %s: %v", envelope.ID, conn.RemoteAddr(), err)
+				eventsDropped.WithLabelValues("unauthenticated").Inc()
+				respond(conn, envelope.ID, protocol.StatusError, err)
+				continue
+			}
+		}
+
+		switch envelope.Type {
+		case protocol.TypeContainerEvent:
+			var container watcher.NextflowContainer
+			if err := envelope.Decode(&container); err != nil {
+				eventsDropped.WithLabelValues("malformed").Inc()
+				respond(conn, envelope.ID, protocol.StatusError, fmt.Errorf("error deserializing container data: %w", err))
+				continue
+			}
+			if !r.AllowList.Matches(container.WorkerIP, conn.RemoteAddr()) {
+				r.rejectWorker(conn, envelope.ID, container.WorkerIP)
+				continue
+			}
+			// Agents keep events they have no ACK for, so a restarted
+			// controller gets them again.
+			if r.ctx != nil && r.ctx.Err() != nil {
+				respond(conn, envelope.ID, protocol.StatusNack, errors.New("controller is shutting down"))
+				continue
+			}
+			// Agents re-send spooled events they have no ACK for.
+			if r.dedup.Seen(envelope.ID) {
+				logrus.Debugf("Acknowledging duplicate event %s", envelope.ID)
+				eventsDropped.WithLabelValues("duplicate").Inc()
+				respond(conn, envelope.ID, protocol.StatusAck, nil)
+				continue
+			}
+			eventsReceived.WithLabelValues(eventType(container), container.WorkerIP).Inc()
+			err := r.handleContainerEvent(envelope.ID, container)
+			if errors.Is(err, watcher.ErrProcessed) {
+				// Re-sent after a controller restart, the state store knows it.
+				logrus.Debugf("Acknowledging processed event %s", envelope.ID)
+				eventsDropped.WithLabelValues("duplicate").Inc()
+				r.dedup.Add(envelope.ID)
+				respond(conn, envelope.ID, protocol.StatusAck, nil)
+				continue
+			}
+			if errors.Is(err, errQueueFull) {
+				respond(conn, envelope.ID, protocol.StatusNack, err)
+				continue
+			}
+			if err != nil {
+				eventsDropped.WithLabelValues("rejected").Inc()
+				respond(conn, envelope.ID, protocol.StatusError, err)
+				continue
+			}
+			r.dedup.Add(envelope.ID)
+			r.Workers.Event(container.WorkerIP)
+			respond(conn, envelope.ID, protocol.StatusAck, nil)
+		case protocol.TypeHeartbeat:
+			var heartbeat protocol.Heartbeat
+			if err := envelope.Decode(&heartbeat); err != nil {
+				eventsDropped.WithLabelValues("malformed").Inc()
+				respond(conn, envelope.ID, protocol.StatusError, fmt.Errorf("error deserializing heartbeat: %w", err))
+				continue
+			}
+			if !r.AllowList.Matches(heartbeat.Worker, conn.RemoteAddr()) {
+				r.rejectWorker(conn, envelope.ID, heartbeat.Worker)
+				continue
+			}
+			eventsReceived.WithLabelValues(string(protocol.TypeHeartbeat), heartbeat.Worker).Inc()
+			r.Workers.Heartbeat(heartbeat)
+			respond(conn, envelope.ID, protocol.StatusAck, nil)
+		default:
+			eventsDropped.WithLabelValues("invalid").Inc()
+			respond(conn, envelope.ID, protocol.StatusError, fmt.Errorf("unknown message type %q", envelope.Type))
+		}
+	}
+}
+
+// rejectWorker NACKs a message naming another worker than the connection's
+// peer. The agent keeps it spooled until its worker_ip is fixed.
+func (r *EventReceiver) rejectWorker(conn *protocol.Conn, id, worker string) {
+	logrus.Warnf("Rejected message %s from %s for worker %s", id, conn.RemoteAddr(), worker)
+	eventsDropped.WithLabelValues("spoofed").Inc()
+	respond(conn, id, protocol.StatusNack, fmt.Errorf("worker %s does not match the connection from %s", worker, conn.RemoteAddr()))
+}
+
+func respond(conn *protocol.Conn, id string, status protocol.Status, err error) {
+	response := protocol.Response{ID: id, Status: status}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if err := conn.WriteResponse(response); err != nil {
+		logrus.Errorf("Error responding to %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// handleContainerEvent moves a remote container through the lifecycle, writes
+// its output and queues dead containers without blocking the connection.
+func (r *EventReceiver) handleContainerEvent(id string, container watcher.NextflowContainer) error {
+	r.pendingMu.Lock()
+	queued, ok := r.pending[id]
+	delete(r.pending, id)
+	r.pendingMu.Unlock()
+	if ok {
+		return r.enqueue(id, queued)
+	}
+
+	var err error
+
+	// Handle the event based on its type.
+	switch container.ContainerEvent {
+	case "[STARTED]":
+		logrus.Infof("[REMOTE START EVENT] Writing container %s to output.", container.Name)
+		if container, err = r.Lifecycle.Transition(watcher.StateStarted, container); err != nil {
+			return err
+		}
+		writeLifecycleOutput(container, r.Metadata)
+		return nil
+	case "[DIED]":
+		logrus.Info("[REMOTE DIE EVENT] Writing container to output and monitoring channel.", container)
+		if container, err = r.Lifecycle.Transition(watcher.StateDied, container); err != nil {
+			return err
+		}
+		writeLifecycleOutput(container, r.Metadata)
+		return r.enqueue(id, container)
+	default:
+		return fmt.Errorf("unknown container event %q", container.ContainerEvent)
+	}
+}
+
+// enqueue hands a dead container over to the monitoring logic, or keeps it
+// for the agent's retry when the queue is full.
+func (r *EventReceiver) enqueue(id string, container watcher.NextflowContainer) error {
+	select {
+	case r.ContainerChannel <- container:
+		return nil
+	default:
+		r.pendingMu.Lock()
+		defer r.pendingMu.Unlock()
+		if r.pending == nil {
+			r.pending = make(map[string]watcher.NextflowContainer)
+		}
+		r.pending[id] = container
+		return errQueueFull
+	}
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+)
+
+func TestRemoteDieWhileQueueIsFull(t *testing.T) {
+	previous := aggregate.OutputDir()
+	aggregate.SetOutputDir(t.TempDir())
+	defer aggregate.SetOutputDir(previous)
+	defer aggregate.OutputFiles.Close()
+
+	queue := make(chan watcher.NextflowContainer, 1)
+	queue <- watcher.NextflowContainer{ContainerID: "other"}
+	receiver := &EventReceiver{Lifecycle: watcher.NewLifecycle(nil), ContainerChannel: queue}
+
+	container := watcher.NextflowContainer{ContainerID: "id", Name: "nxf-task", ContainerEvent: "[DIED]", DieTime: time.Unix(100, 0)}
+	if err := receiver.handleContainerEvent("event", container); !errors.Is(err, errQueueFull) {
+		t.Fatalf("got error %v, want errQueueFull", err)
+	}
+
+	// The retry is not rejected as a repeated die and succeeds once the
+	// queue has room.
+	<-queue
+	if err := receiver.handleContainerEvent("event", container); err != nil {
+		t.Fatal(err)
+	}
+	if queued := <-queue; queued.ContainerID != "id" {
+		t.Errorf("got container %s queued, want id", queued.ContainerID)
+	}
+	if len(receiver.pending) != 0 {
+		t.Errorf("got %d pending containers after the retry, want none", len(receiver.pending))
+	}
+}
+
+func TestEventForOtherWorkerIsNacked(t *testing.T) {
+	previous := aggregate.OutputDir()
+	aggregate.SetOutputDir(t.TempDir())
+	defer aggregate.SetOutputDir(previous)
+	defer aggregate.OutputFiles.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	receiver := &EventReceiver{
+		AllowList: newWorkerAllowList(Security{RestrictToWorkers: true}, []string{"127.0.0.1", "10.0.0.2"}),
+		Lifecycle: watcher.NewLifecycle(nil),
+		Workers:   NewWorkerRegistry(nil, time.Minute),
+		dedup:     newEventDeduplicator(),
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		receiver.HandleIncomingContainerEvents(conn)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := protocol.NewConn(client)
+	defer conn.Close()
+
+	tests := []struct {
+		name    string
+		typ     protocol.MessageType
+		payload any
+		status  protocol.Status
+	}{
+		{"event for other worker", protocol.TypeContainerEvent, watcher.NextflowContainer{ContainerID: "a", ContainerEvent: "[STARTED]", WorkerIP: "10.0.0.2"}, protocol.StatusNack},
+		{"heartbeat for other worker", protocol.TypeHeartbeat, protocol.Heartbeat{Worker: "10.0.0.2"}, protocol.StatusNack},
+		{"event for own worker", protocol.TypeContainerEvent, watcher.NextflowContainer{ContainerID: "b", ContainerEvent: "[STARTED]", WorkerIP: "127.0.0.1"}, protocol.StatusAck},
+		{"heartbeat for own worker", protocol.TypeHeartbeat, protocol.Heartbeat{Worker: "127.0.0.1"}, protocol.StatusAck},
+	}
+	for _, test := range tests {
+		envelope, err := protocol.NewEnvelope(test.typ, test.name, test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := conn.Send(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != test.status {
+			t.Errorf("%s: got status %q, want %q", test.name, response.Status, test.status)
+		}
+	}
+	if _, ok := receiver.Lifecycle.Container("a"); ok {
+		t.Error("an event for another worker changed the lifecycle")
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		listen     Listen
+		controller string
+		network    string
+		address    string
+	}{
+		{"default port", Listen{}, "10.0.0.1", "tcp", "10.0.0.1:42"},
+		{"ipv6 controller", Listen{}, "fd00::1", "tcp", "[fd00::1]:42"},
+		{"hostname controller", Listen{}, "controller", "tcp", "controller:42"},
+		{"configured address", Listen{Address: "[::]:4242"}, "10.0.0.1", "tcp", "[::]:4242"},
+		{"unix socket", Listen{Address: ":4242", UnixSocket: "/run/monitor.sock"}, "10.0.0.1", "unix", "/run/monitor.sock"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Listen: test.listen}
+			config.ServerConfigurations.Prometheus.TargetServer.Controller = test.controller
+			network, address := ListenAddress(config)
+			if network != test.network || address != test.address {
+				t.Errorf("got %s %s, want %s %s", network, address, test.network, test.address)
+			}
+		})
+	}
+}
+
+func TestCreateListenerReplacesStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "monitor.sock")
+	config := &Config{Listen: Listen{UnixSocket: socket}}
+	for i := 0; i < 2; i++ {
+		listener, err := CreateListener(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Closing a Unix listener removes the socket, leave one behind
+		// like a crashed controller.
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+	}
+	if _, err := os.Stat(socket); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefix of the metrics the monitor exposes about itself.
+const metricsNamespace = "lowlevelmonitoring"
+
+// Metrics about the monitor itself, served on /metrics.
+var (
+	eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "Container events and heartbeats received, by type and worker.",
+	}, []string{"type", "worker"})
+
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_dropped_total",
+		Help:      "Events that were discarded, by reason.",
+	}, []string{"reason"})
+
+	eventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_sent_total",
+		Help:      "Events sent by an agent, by controller response.",
+	}, []string{"status"})
+
+	processingLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "processing_latency_seconds",
+		Help:      "Time from a container's death until its output is written.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+
+	processingErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "processing_errors_total",
+		Help:      "Dead containers whose processing failed.",
+	})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Duration of Prometheus range queries, by data source and metric.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "metric"})
+
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_errors_total",
+		Help:      "Failed Prometheus range queries, by data source and metric.",
+	}, []string{"source", "metric"})
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "output_bytes_written_total",
+		Help:      "Bytes of task metric output written.",
+	}, func() float64 { return float64(aggregate.BytesWritten()) })
+)
+
+// eventType is the label value of a container event, e.g. "died".
+func eventType(container watcher.NextflowContainer) string {
+	return strings.ToLower(strings.Trim(container.ContainerEvent, "[]"))
+}
+
+// registerQueueDepth exposes the length of a queue owned by a component.
+func registerQueueDepth(queue string, depth func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "queue_depth",
+		Help:        "Items waiting in the monitor's queues.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 { return float64(depth()) }))
+}
+
+// registerLifecycleStates exposes how many containers are in each lifecycle
+// state. Evicted counts all records dropped since the start.
+func registerLifecycleStates(lifecycle *watcher.Lifecycle) {
+	for _, state := range []watcher.LifecycleState{watcher.StateCreated, watcher.StateStarted, watcher.StatePaused, watcher.StateDied, watcher.StateProcessed, watcher.StateEvicted} {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "containers",
+			Help:        "Containers per lifecycle state.",
+			ConstLabels: prometheus.Labels{"state": string(state)},
+		}, func() float64 { return float64(lifecycle.Counts()[state]) }))
+	}
+}
+
+// ServeMetrics serves /metrics in the background if an address is configured
+// and stops when the context is cancelled.
+func ServeMetrics(ctx context.Context, address string) {
+	if address == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	serveHTTP(ctx, &http.Server{Addr: address, Handler: mux}, "metrics")
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestEventType(t *testing.T) {
+	for event, want := range map[string]string{"[STARTED]": "started", "[DIED]": "died", "": ""} {
+		if got := eventType(watcher.NextflowContainer{ContainerEvent: event}); got != want {
+			t.Errorf("event %q: got %q, want %q", event, got, want)
+		}
+	}
+}
+
+func TestMetricsAreExposed(t *testing.T) {
+	// Metrics are global, unique labels keep repeated runs apart.
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	eventsReceived.WithLabelValues("died", id).Inc()
+	registerQueueDepth(id, func() int { return 3 })
+
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, want := range []string{
+		`lowlevelmonitoring_events_received_total{type="died",worker="` + id + `"} 1`,
+		`lowlevelmonitoring_queue_depth{queue="` + id + `"} 3`,
+		`lowlevelmonitoring_output_bytes_written_total`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProcessingWorkers = 4
+	defaultQueueSize         = 1000
+)
+
+func (p Processing) WorkerCount() int {
+	if p.Workers <= 0 {
+		return defaultProcessingWorkers
+	}
+	return p.Workers
+}
+
+func (p Processing) QueueCapacity() int {
+	if p.QueueSize <= 0 {
+		return defaultQueueSize
+	}
+	return p.QueueSize
+}
+
+// ProcessingPool processes dead containers with a bounded number of workers.
+// Containers wait in a buffered queue, senders only block once it is full.
+type ProcessingPool struct {
+	config     *Config
+	configPath string
+	lifecycle  *watcher.Lifecycle
+	sink       aggregate.OutputSink
+	queue      chan watcher.NextflowContainer
+	busy       atomic.Int64
+	wg         sync.WaitGroup
+}
+
+func NewProcessingPool(config *Config, configPath string, lifecycle *watcher.Lifecycle, sink aggregate.OutputSink) *ProcessingPool {
+	return &ProcessingPool{
+		config:     config,
+		configPath: configPath,
+		lifecycle:  lifecycle,
+		sink:       sink,
+		queue:      make(chan watcher.NextflowContainer, config.Processing.QueueCapacity()),
+	}
+}
+
+// Queue is the channel dead containers are handed over on.
+func (p *ProcessingPool) Queue() chan<- watcher.NextflowContainer {
+	return p.queue
+}
+
+// Len returns the number of queued containers.
+func (p *ProcessingPool) Len() int {
+	return len(p.queue)
+}
+
+// Busy returns the number of containers being processed.
+func (p *ProcessingPool) Busy() int {
+	return int(p.busy.Load())
+}
+
+// Idle reports whether no container is queued or being processed.
+func (p *ProcessingPool) Idle() bool {
+	return p.Len() == 0 && p.Busy() == 0
+}
+
+// Start runs the workers until the context is cancelled.
+func (p *ProcessingPool) Start(ctx context.Context) {
+	workers := p.config.Processing.WorkerCount()
+	logrus.Infof("Processing dead containers with %d workers", workers)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case workflowContainer := <-p.queue:
+					p.process(ctx, workflowContainer)
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until all workers returned.
+func (p *ProcessingPool) Wait() {
+	p.wg.Wait()
+}
+
+// process isolates the failure of one container from the others. Failed
+// containers stay pending in the lifecycle and are retried on the next start.
+func (p *ProcessingPool) process(ctx context.Context, workflowContainer watcher.NextflowContainer) {
+	p.busy.Add(1)
+	defer p.busy.Add(-1)
+	defer func() {
+		if r := recover(); r != nil {
+			processingErrors.Inc()
+			logrus.Errorf("Panic while processing container %s: %v", workflowContainer.Name, r)
+		}
+	}()
+
+	if err := ProcessContainerEvent(ctx, p.config, p.configPath, p.lifecycle, p.sink, workflowContainer); err != nil {
+		processingErrors.Inc()
+		logrus.Errorf("Error processing container %s: %v", workflowContainer.Name, err)
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QueryStatus describes a Prometheus query issued for a container.
+type QueryStatus struct {
+	Container string    `json:"container"`
+	Target    string    `json:"target"`
+	Source    string    `json:"source"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	Started   time.Time `json:"started"`
+	Duration  string    `json:"duration,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Number of failed queries kept for inspection.
+const failedQueriesCapacity = 200
+
+// QueryTracker keeps the queries in flight and the most recent failures.
+type QueryTracker struct {
+	mu      sync.Mutex
+	pending map[string]QueryStatus
+	failed  []QueryStatus
+}
+
+func NewQueryTracker() *QueryTracker {
+	return &QueryTracker{pending: make(map[string]QueryStatus)}
+}
+
+// Tracks the queries issued by fetchQuery.
+var queryTracker = NewQueryTracker()
+
+func queryKey(q QueryStatus) string {
+	return fmt.Sprintf("%s/%s/%s/%s", q.Container, q.Target, q.Source, q.Name)
+}
+
+// Start registers a query before it is sent.
+func (t *QueryTracker) Start(q QueryStatus) {
+	q.Started = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[queryKey(q)] = q
+}
+
+// Done removes the query from the pending set and keeps it if it failed.
+func (t *QueryTracker) Done(q QueryStatus, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := queryKey(q)
+	if started, ok := t.pending[key]; ok {
+		q = started
+	}
+	delete(t.pending, key)
+	if err == nil {
+		return
+	}
+	q.Duration = time.Since(q.Started).String()
+	q.Error = err.Error()
+	t.failed = append(t.failed, q)
+	if len(t.failed) > failedQueriesCapacity {
+		t.failed = t.failed[len(t.failed)-failedQueriesCapacity:]
+	}
+}
+
+// Pending returns the queries currently in flight.
+func (t *QueryTracker) Pending() []QueryStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queries := make([]QueryStatus, 0, len(t.pending))
+	for _, q := range t.pending {
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// Failed returns the most recent failed queries, oldest first.
+func (t *QueryTracker) Failed() []QueryStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]QueryStatus(nil), t.failed...)
+}
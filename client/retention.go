@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/sirupsen/logrus"
+)
+
+// How often the controller enforces the retention policy.
+const retentionInterval = time.Minute
+
+// Retention limits the output kept on disk. Zero values keep everything.
+type Retention struct {
+	// Earlier run directories and rotated files older than this are removed.
+	MaxAge string `yaml:"max_age"`
+	// While the results directory is larger than this, earlier run
+	// directories and then rotated files of the current run are removed,
+	// oldest first. The files being written are never removed.
+	MaxSizeMB int64 `yaml:"max_size_mb"`
+}
+
+func (r Retention) MaxAgeDuration() time.Duration {
+	return parseDuration(r.MaxAge, 0)
+}
+
+func (r Retention) enabled() bool {
+	return r.MaxAgeDuration() > 0 || r.MaxSizeMB > 0
+}
+
+// EnforceRetention applies the retention policy to the results directory
+// until the context is cancelled. outputDir is the directory of the current
+// run below it, which is never removed.
+func EnforceRetention(ctx context.Context, retention Retention, resultsDir, outputDir string) {
+	if !retention.enabled() {
+		return
+	}
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		applyRetention(retention, resultsDir, outputDir)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func applyRetention(retention Retention, resultsDir, outputDir string) {
+	maxAge := retention.MaxAgeDuration()
+	maxSize := retention.MaxSizeMB * 1024 * 1024
+
+	var total int64
+	var runs []runDir
+	for _, run := range earlierRuns(resultsDir, outputDir, maxSize > 0) {
+		if maxAge > 0 && time.Since(run.modTime) > maxAge {
+			removeRun(run.dir)
+			continue
+		}
+		runs = append(runs, run)
+		total += run.size
+	}
+
+	type rotatedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var rotated []rotatedFile
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Skip the controller state and, for the flat layout, earlier runs.
+			if path != outputDir && (strings.HasPrefix(d.Name(), ".") || isRunDir(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		if aggregate.IsRotatedFile(path) {
+			rotated = append(rotated, rotatedFile{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Error("Error listing output for retention: ", err)
+		return
+	}
+
+	for _, run := range runs {
+		if maxSize <= 0 || total <= maxSize {
+			break
+		}
+		if removeRun(run.dir) {
+			total -= run.size
+		}
+	}
+
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].modTime.Before(rotated[j].modTime) })
+	for _, file := range rotated {
+		expired := maxAge > 0 && time.Since(file.modTime) > maxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil {
+			logrus.Errorf("Error removing %s: %v", file.path, err)
+			continue
+		}
+		logrus.Infof("Removed rotated file %s by retention policy", file.path)
+		total -= file.size
+	}
+}
+
+// runDir is an earlier run in the results directory.
+type runDir struct {
+	dir     string
+	modTime time.Time // Of the manifest, written last when the run finished.
+	size    int64     // Only set if requested.
+}
+
+// earlierRuns returns the run directories in resultsDir other than outputDir,
+// oldest first.
+func earlierRuns(resultsDir, outputDir string, withSize bool) []runDir {
+	entries, err := os.ReadDir(resultsDir)
+	if err != nil {
+		logrus.Error("Error listing runs for retention: ", err)
+		return nil
+	}
+	var runs []runDir
+	for _, entry := range entries {
+		dir := filepath.Join(resultsDir, entry.Name())
+		if !entry.IsDir() || dir == filepath.Clean(outputDir) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, manifestFileName))
+		if err != nil {
+			continue
+		}
+		run := runDir{dir: dir, modTime: info.ModTime()}
+		if withSize {
+			run.size = dirSize(dir)
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].modTime.Before(runs[j].modTime) })
+	return runs
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func removeRun(dir string) bool {
+	if err := os.RemoveAll(dir); err != nil {
+		logrus.Errorf("Error removing run %s: %v", dir, err)
+		return false
+	}
+	logrus.Infof("Removed run %s by retention policy", dir)
+	return true
+}
+
+func isRunDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, manifestFileName))
+	return err == nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRun creates a finished run of the given size whose manifest was
+// written at finished.
+func writeRun(t *testing.T, resultsDir, id string, size int, finished time.Time) string {
+	t.Helper()
+	dir := filepath.Join(resultsDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, manifestFileName)
+	if err := os.WriteFile(manifest, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metric.csv"), []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(manifest, finished, finished); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRetentionRemovesOldestRunsBySize(t *testing.T) {
+	resultsDir := t.TempDir()
+
+	const mb = 1024 * 1024
+	now := time.Now()
+	oldest := writeRun(t, resultsDir, "20250101T000000Z", mb, now.Add(-3*time.Hour))
+	older := writeRun(t, resultsDir, "20250102T000000Z", mb, now.Add(-2*time.Hour))
+	current := writeRun(t, resultsDir, "20250103T000000Z", mb/2, now)
+
+	applyRetention(Retention{MaxSizeMB: 2}, resultsDir, current)
+
+	for dir, kept := range map[string]bool{oldest: false, older: true, current: true} {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Errorf("run %s: got kept %v, want %v", dir, err == nil, kept)
+		}
+	}
+}
+
+func TestRetentionRemovesRotatedFilesOfCurrentRun(t *testing.T) {
+	resultsDir := t.TempDir()
+
+	const mb = 1024 * 1024
+	current := writeRun(t, resultsDir, "20250103T000000Z", mb, time.Now())
+	rotated := filepath.Join(current, "metric.20250103T010000Z.csv")
+	if err := os.WriteFile(rotated, []byte(strings.Repeat("x", mb)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	applyRetention(Retention{MaxSizeMB: 1}, resultsDir, current)
+
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Error("rotated file was kept")
+	}
+	// The file being written is never removed.
+	if _, err := os.Stat(filepath.Join(current, "metric.csv")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	manifestFileName = "manifest.json"
+	configCopyName   = "config.yml"
+)
+
+// Manifest describes a monitoring run and the files it produced.
+type Manifest struct {
+	RunID      string                      `json:"run_id"`
+	StartTime  time.Time                   `json:"start_time"`
+	EndTime    *time.Time                  `json:"end_time,omitempty"` // Unset while the run is active.
+	Version    string                      `json:"monitor_version"`
+	ConfigHash string                      `json:"config_sha256"`
+	ConfigFile string                      `json:"config_file"` // Copy of the configuration, relative to the run.
+	Prometheus []string                    `json:"prometheus_backends"`
+	Formats    []string                    `json:"output_formats"`
+	Workers    []WorkerStatus              `json:"workers"`
+	Files      []aggregate.FileDescription `json:"files"`
+}
+
+// Run is a monitoring session writing into its own directory below results/.
+// A nil Run means run directories are disabled.
+type Run struct {
+	Dir      string
+	manifest Manifest
+}
+
+// StartRun creates the directory of a new run, makes it the output directory
+// and writes the initial manifest. It returns nil if runs are disabled.
+func StartRun(config *Config, configPath string) (*Run, error) {
+	if !config.Output.Runs {
+		return nil, nil
+	}
+
+	started := time.Now()
+	id, err := createRunDir(aggregate.DefaultOutputDir, started.UTC().Format("20060102T150405Z"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating run directory: %w", err)
+	}
+	run := &Run{
+		Dir: filepath.Join(aggregate.DefaultOutputDir, id),
+		manifest: Manifest{
+			RunID:      id,
+			StartTime:  started,
+			Version:    Version,
+			ConfigFile: configCopyName,
+			Prometheus: []string{config.ServerConfigurations.Prometheus.TargetServer.Address},
+			Formats:    config.Output.Formats,
+		},
+	}
+	// Keep the configuration the run was monitored with.
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	run.manifest.ConfigHash = hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(run.Dir, configCopyName), data, 0644); err != nil {
+		return nil, fmt.Errorf("error copying config: %w", err)
+	}
+
+	if err := run.writeManifest(); err != nil {
+		return nil, err
+	}
+	aggregate.SetOutputDir(run.Dir)
+	logrus.Infof("Writing results of run %s to %s", id, run.Dir)
+	return run, nil
+}
+
+// createRunDir creates the directory of a run below dir and returns its ID.
+// Runs started within the same second get a -2, -3, ... suffix.
+func createRunDir(dir, id string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	for n := 1; ; n++ {
+		candidate := id
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", id, n)
+		}
+		err := os.Mkdir(filepath.Join(dir, candidate), 0755)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return candidate, err
+	}
+}
+
+// OutputDir returns the directory the run's results are written to.
+func (r *Run) OutputDir() string {
+	if r == nil {
+		return aggregate.DefaultOutputDir
+	}
+	return r.Dir
+}
+
+// Finish completes the manifest with the end time, the workers and the
+// produced files. Outputs must be closed before.
+func (r *Run) Finish(workers []WorkerStatus) {
+	if r == nil {
+		return
+	}
+	end := time.Now()
+	r.manifest.EndTime = &end
+	r.manifest.Workers = workers
+	r.manifest.Files = nil
+
+	err := filepath.WalkDir(r.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(r.Dir, path)
+		if err != nil || rel == manifestFileName || rel == configCopyName {
+			return err
+		}
+		description, err := aggregate.DescribeFile(path)
+		if err != nil {
+			logrus.Warnf("Error describing %s: %v", path, err)
+		}
+		description.Path = filepath.ToSlash(rel)
+		r.manifest.Files = append(r.manifest.Files, description)
+		return nil
+	})
+	if err != nil {
+		logrus.Error("Error listing run files: ", err)
+	}
+	if err := r.writeManifest(); err != nil {
+		logrus.Error("Error writing run manifest: ", err)
+		return
+	}
+	logrus.Infof("Run %s finished with %d files", r.manifest.RunID, len(r.manifest.Files))
+}
+
+// writeManifest replaces the manifest atomically.
+func (r *Run) writeManifest() error {
+	data, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.Dir, manifestFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,23 @@
+package client
+
+import "testing"
+
+func TestCreateRunDirIsUnique(t *testing.T) {
+	dir := t.TempDir()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		id, err := createRunDir(dir, "20250101T000000Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("run ID %s was handed out twice", id)
+		}
+		seen[id] = true
+	}
+	for _, id := range []string{"20250101T000000Z", "20250101T000000Z-2", "20250101T000000Z-3"} {
+		if !seen[id] {
+			t.Errorf("missing run ID %s, got %v", id, seen)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Security protects the channel between agents and the controller.
+type Security struct {
+	TLS TLS `yaml:"tls"`
+	// Key for the HMAC every event is signed with. Disabled when empty.
+	SharedSecret string `yaml:"shared_secret"`
+	// Only accept connections from the configured workers.
+	RestrictToWorkers bool `yaml:"restrict_to_workers"`
+}
+
+// TLS settings. The controller presents CertFile and verifies client
+// certificates against CAFile, agents present CertFile as client certificate
+// and verify the controller against CAFile.
+type TLS struct {
+	Enabled    bool   `yaml:"enabled"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ServerName string `yaml:"server_name"` // Expected controller name, agents only.
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the controller's TLS config, or nil if TLS is off.
+// Client certificates are required as soon as a CA file is configured.
+func (s Security) ServerTLSConfig() (*tls.Config, error) {
+	if !s.TLS.Enabled {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.TLS.CertFile, s.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.TLS.CAFile != "" {
+		pool, err := loadCertPool(s.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns the agent's TLS config, or nil if TLS is off.
+func (s Security) ClientTLSConfig() (*tls.Config, error) {
+	if !s.TLS.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: s.TLS.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if s.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLS.CertFile, s.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if s.TLS.CAFile != "" {
+		pool, err := loadCertPool(s.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (s Security) Secret() []byte {
+	if s.SharedSecret == "" {
+		return nil
+	}
+	return []byte(s.SharedSecret)
+}
+
+// workerAllowList holds the IPs of the configured workers.
+type workerAllowList map[string]struct{}
+
+// newWorkerAllowList resolves the configured workers, which may be IPs or
+// hostnames. It returns nil when connections are not restricted.
+func newWorkerAllowList(s Security, workers []string) workerAllowList {
+	if !s.RestrictToWorkers {
+		return nil
+	}
+	allowed := make(workerAllowList)
+	for _, worker := range workers {
+		ips, err := resolveWorker(worker)
+		if err != nil {
+			logrus.Warnf("Error resolving worker %s: %v", worker, err)
+			continue
+		}
+		for _, ip := range ips {
+			allowed[ip] = struct{}{}
+		}
+	}
+	return allowed
+}
+
+// resolveWorker returns the normalized IPs of a worker given as IP or hostname.
+func resolveWorker(worker string) ([]string, error) {
+	if ip := net.ParseIP(worker); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	addrs, err := net.LookupHost(worker)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	return ips, nil
+}
+
+// remoteIP returns the normalized IP of a TCP peer.
+func remoteIP(addr net.Addr) (string, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// Allows reports whether the remote address belongs to a configured worker.
+func (a workerAllowList) Allows(addr net.Addr) bool {
+	// Unix sockets are only reachable from the local node.
+	if a == nil || addr.Network() == "unix" {
+		return true
+	}
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return false
+	}
+	_, ok = a[ip]
+	return ok
+}
+
+// Matches reports whether the worker a payload names is the remote peer, so
+// an allowed worker cannot report events in the name of another one.
+func (a workerAllowList) Matches(worker string, addr net.Addr) bool {
+	if a == nil || addr.Network() == "unix" {
+		return true
+	}
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return false
+	}
+	ips, err := resolveWorker(worker)
+	if err != nil {
+		return false
+	}
+	for _, resolved := range ips {
+		if resolved == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+	"github.com/sirupsen/logrus"
+)
+
+// Shutdown configures what happens on SIGINT or SIGTERM.
+type Shutdown struct {
+	// How long queued dead containers and spooled agent events are still
+	// processed. Whatever is left is picked up on the next start.
+	DrainTimeout string `yaml:"drain_timeout"`
+}
+
+const (
+	defaultDrainTimeout = 1 * time.Minute
+	// The drain ends once no container was queued for this long.
+	drainIdleTimeout = 1 * time.Second
+	// Time given to open HTTP requests when a server shuts down.
+	httpShutdownTimeout = 5 * time.Second
+)
+
+func (s Shutdown) DrainTimeoutDuration() time.Duration {
+	return parseDuration(s.DrainTimeout, defaultDrainTimeout)
+}
+
+// DrainContainerEvents waits for the pool to process the dead containers
+// still queued after a shutdown was requested. It returns once the local
+// watcher stopped and the pool stayed idle for a while, or when the
+// processing context is cancelled at the drain deadline. Unprocessed
+// containers stay in the state store.
+func DrainContainerEvents(ctx context.Context, config *Config, lifecycle *watcher.Lifecycle, pool *ProcessingPool, watcherDone <-chan struct{}) {
+	logrus.Infof("Shutting down, draining %d queued containers for up to %v", pool.Len(), config.Shutdown.DrainTimeoutDuration())
+	ticker := time.NewTicker(drainIdleTimeout)
+	defer ticker.Stop()
+	idle := false
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Warnf("Drain deadline passed, %d containers are left for the next start", lifecycle.Counts()[watcher.StateDied])
+			return
+		case <-ticker.C:
+			select {
+			case <-watcherDone:
+				// Require two idle checks in a row so late remote events are
+				// still picked up.
+				if idle && pool.Idle() {
+					logrus.Info("Drained all queued containers")
+					return
+				}
+				idle = pool.Idle()
+			default:
+			}
+		}
+	}
+}
+
+// serveHTTP runs the server until the context is cancelled.
+func serveHTTP(ctx context.Context, server *http.Server, name string) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logrus.Infof("Serving %s on %s", name, server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Error serving %s: %v", name, err)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/watcher"
+)
+
+// drain runs DrainContainerEvents and fails if it does not return in time.
+func drain(t *testing.T, ctx context.Context, pool *ProcessingPool, lifecycle *watcher.Lifecycle, watcherDone <-chan struct{}) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		DrainContainerEvents(ctx, &Config{}, lifecycle, pool, watcherDone)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return")
+	}
+}
+
+func TestDrainReturnsOnceIdle(t *testing.T) {
+	lifecycle := watcher.NewLifecycle(nil)
+	pool := NewProcessingPool(&Config{}, "", lifecycle, nil)
+	watcherDone := make(chan struct{})
+	close(watcherDone)
+	drain(t, context.Background(), pool, lifecycle, watcherDone)
+}
+
+func TestDrainStopsAtDeadline(t *testing.T) {
+	lifecycle := watcher.NewLifecycle(nil)
+	pool := NewProcessingPool(&Config{}, "", lifecycle, nil)
+	// Nobody processes the queue, so only the deadline ends the drain.
+	pool.Queue() <- watcher.NextflowContainer{ContainerID: "id"}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	drain(t, ctx, pool, lifecycle, make(chan struct{}))
+	if pool.Len() != 1 {
+		t.Errorf("got %d queued containers, want the container left for the next start", pool.Len())
+	}
+}
+
+func TestServeHTTPStopsOnCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveHTTP(ctx, &http.Server{Addr: address, Handler: http.NotFoundHandler()}, "test")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, err := http.Get("http://" + address)
+		if err == nil {
+			response.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts connections after the cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	spoolFileName  = "spool.jsonl"
+	offsetFileName = "spool.offset"
+	// The file is compacted once this many delivered envelopes or more than
+	// half of it were acknowledged.
+	compactAfterAcks = 1000
+)
+
+// Spool keeps outgoing envelopes on disk until the controller acknowledged
+// them. Envelopes are delivered strictly in the order they were appended.
+type Spool struct {
+	mu         sync.Mutex
+	path       string
+	offsetPath string
+	file       *os.File
+	pending    []protocol.Envelope
+	acked      int // Envelopes at the head of the file that were delivered.
+	notify     chan struct{}
+}
+
+// OpenSpool opens the spool in dir and drops envelopes acknowledged before the
+// last shutdown.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+	s := &Spool{
+		path:       filepath.Join(dir, spoolFileName),
+		offsetPath: filepath.Join(dir, offsetFileName),
+		notify:     make(chan struct{}, 1),
+	}
+
+	acked := 0
+	if data, err := os.ReadFile(s.offsetPath); err == nil {
+		acked, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	envelopes, err := readSpoolFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if acked < len(envelopes) {
+		s.pending = envelopes[acked:]
+	}
+	if err := s.rewrite(); err != nil {
+		return nil, err
+	}
+	if len(s.pending) > 0 {
+		logrus.Infof("[AGENT] %d undelivered events in spool %s", len(s.pending), s.path)
+		s.signal()
+	}
+	return s, nil
+}
+
+func readSpoolFile(path string) ([]protocol.Envelope, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening spool: %w", err)
+	}
+	defer file.Close()
+
+	var envelopes []protocol.Envelope
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), protocol.MaxMessageSize)
+	for scanner.Scan() {
+		var envelope protocol.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &envelope); err != nil {
+			logrus.Warn("Skipping corrupt spool entry: ", err)
+			continue
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes, scanner.Err()
+}
+
+// rewrite replaces the spool file with the pending envelopes and resets the offset.
+func (s *Spool) rewrite() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating spool: %w", err)
+	}
+	encoder := json.NewEncoder(tmp)
+	for _, envelope := range s.pending {
+		if err := encoder.Encode(envelope); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing spool: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	// Reset the offset first: a crash in between re-sends delivered envelopes,
+	// which the controller drops, instead of skipping undelivered ones.
+	s.acked = 0
+	if err := writeFileAtomic(s.offsetPath, []byte("0")); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+func (s *Spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Append persists the envelope before it is queued for delivery. Envelopes
+// too large to ever be sent are refused with protocol.ErrTooLarge.
+func (s *Spool) Append(envelope protocol.Envelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if len(data) >= protocol.MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", protocol.ErrTooLarge, len(data))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing spool: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool: %w", err)
+	}
+	s.pending = append(s.pending, envelope)
+	s.signal()
+	return nil
+}
+
+// Next returns the oldest undelivered envelope, blocking until there is one
+// or the context is cancelled.
+func (s *Spool) Next(ctx context.Context) (protocol.Envelope, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			envelope := s.pending[0]
+			s.mu.Unlock()
+			return envelope, nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return protocol.Envelope{}, ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+// Ack removes the oldest envelope once it was delivered.
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	s.pending = s.pending[1:]
+	s.acked++
+
+	// Drop the delivered envelopes from the file, so it does not grow while
+	// the controller lags behind.
+	if len(s.pending) == 0 || s.acked >= compactAfterAcks || s.acked > len(s.pending) {
+		return s.rewrite()
+	}
+	return writeFileAtomic(s.offsetPath, []byte(strconv.Itoa(s.acked)))
+}
+
+// writeFileAtomic replaces the file so a crash leaves either the old or the
+// new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Len returns the number of undelivered envelopes.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
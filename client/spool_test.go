@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+)
+
+func appendEnvelopes(t *testing.T, spool *Spool, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		envelope, err := protocol.NewEnvelope(protocol.TypeContainerEvent, id, map[string]string{"id": id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := spool.Append(envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func nextID(t *testing.T, spool *Spool) string {
+	t.Helper()
+	envelope, err := spool.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope.ID
+}
+
+func TestSpoolResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEnvelopes(t, spool, "a", "b", "c")
+	if id := nextID(t, spool); id != "a" {
+		t.Fatalf("got %s, want a", id)
+	}
+	if err := spool.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+
+	spool, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Len() != 2 {
+		t.Fatalf("got %d envelopes, want 2", spool.Len())
+	}
+	for _, want := range []string{"b", "c"} {
+		if id := nextID(t, spool); id != want {
+			t.Fatalf("got %s, want %s", id, want)
+		}
+		spool.Ack()
+	}
+	if spool.Len() != 0 {
+		t.Errorf("got %d envelopes after delivering all, want 0", spool.Len())
+	}
+	// Delivering everything starts over with an empty spool.
+	data, err := os.ReadFile(filepath.Join(dir, offsetFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := strconv.Atoi(string(data)); offset != 0 {
+		t.Errorf("got offset %d, want 0", offset)
+	}
+}
+
+func TestSpoolCrashDuringRewrite(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEnvelopes(t, spool, "a", "b")
+	spool.Ack()
+	spool.Close()
+
+	// A crash after the offset was reset but before the compacted spool was
+	// renamed into place re-sends the delivered envelope instead of losing
+	// the undelivered one.
+	if err := writeFileAtomic(filepath.Join(dir, offsetFileName), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	spool, err = OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if id := nextID(t, spool); id != "a" {
+		t.Errorf("got %s, want the delivered a again", id)
+	}
+	if spool.Len() != 2 {
+		t.Errorf("got %d envelopes, want 2", spool.Len())
+	}
+}
+
+func TestSpoolRefusesOversizedEnvelope(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	envelope, err := protocol.NewEnvelope(protocol.TypeContainerEvent, "big", strings.Repeat("x", protocol.MaxMessageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(envelope); !errors.Is(err, protocol.ErrTooLarge) {
+		t.Errorf("got error %v, want ErrTooLarge", err)
+	}
+	if spool.Len() != 0 {
+		t.Errorf("got %d envelopes, want 0", spool.Len())
+	}
+}
+
+func TestSpoolCompactsWhileDelivering(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	ids := make([]string, 3*compactAfterAcks)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	appendEnvelopes(t, spool, ids...)
+	path := filepath.Join(dir, spoolFileName)
+	full, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The controller lags behind, the spool never runs empty.
+	for i := 0; i < compactAfterAcks; i++ {
+		if err := spool.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compacted, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.Size() >= full.Size() {
+		t.Errorf("spool file holds %d bytes after delivering a third, want less than %d", compacted.Size(), full.Size())
+	}
+	if id := nextID(t, spool); id != strconv.Itoa(compactAfterAcks) {
+		t.Errorf("got %s next, want %d", id, compactAfterAcks)
+	}
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the monitor, set at build time via -ldflags.
+var Version = "dev"
+
+// Heartbeat configures the liveness tracking of agents.
+type Heartbeat struct {
+	Interval string `yaml:"interval"` // How often agents send a heartbeat.
+	Timeout  string `yaml:"timeout"`  // Silence after which a worker counts as unavailable.
+}
+
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultHeartbeatTimeout  = 90 * time.Second
+)
+
+func parseDuration(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		logrus.Warnf("Invalid duration %q, using %v", value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func (h Heartbeat) IntervalDuration() time.Duration {
+	return parseDuration(h.Interval, defaultHeartbeatInterval)
+}
+
+func (h Heartbeat) TimeoutDuration() time.Duration {
+	return parseDuration(h.Timeout, defaultHeartbeatTimeout)
+}
+
+// WorkerStatus is what the controller knows about a worker.
+type WorkerStatus struct {
+	Worker     string    `json:"worker"`
+	Configured bool      `json:"configured"`
+	Available  bool      `json:"available"`
+	LastSeen   time.Time `json:"last_seen"`
+	Version    string    `json:"version"`
+	Events     int64     `json:"events"`
+	Heartbeats int64     `json:"heartbeats"`
+	Spooled    int       `json:"spooled"`
+
+	silent bool // Unavailability was already reported.
+}
+
+// WorkerRegistry tracks the liveness of the configured workers and of every
+// agent that contacted the controller.
+type WorkerRegistry struct {
+	mu      sync.Mutex
+	workers map[string]*WorkerStatus
+	aliases map[string]string // Resolved IPs of the configured workers.
+	timeout time.Duration
+	started time.Time
+}
+
+func NewWorkerRegistry(configured []string, timeout time.Duration) *WorkerRegistry {
+	r := &WorkerRegistry{
+		workers: make(map[string]*WorkerStatus),
+		aliases: make(map[string]string),
+		timeout: timeout,
+		started: time.Now(),
+	}
+	// Agents report their IP, configured workers may be hostnames.
+	for _, worker := range configured {
+		r.workers[worker] = &WorkerStatus{Worker: worker, Configured: true}
+		ips, err := resolveWorker(worker)
+		if err != nil {
+			logrus.Warnf("Error resolving worker %s: %v", worker, err)
+			continue
+		}
+		for _, ip := range ips {
+			r.aliases[ip] = worker
+		}
+	}
+	return r
+}
+
+// seen must be called with the lock held.
+func (r *WorkerRegistry) seen(worker string) *WorkerStatus {
+	if ip := net.ParseIP(worker); ip != nil {
+		worker = ip.String()
+	}
+	if configured, ok := r.aliases[worker]; ok {
+		worker = configured
+	}
+	status, ok := r.workers[worker]
+	if !ok {
+		logrus.Warnf("[WORKER] Agent %s is not in the configured worker list", worker)
+		status = &WorkerStatus{Worker: worker}
+		r.workers[worker] = status
+	}
+	status.LastSeen = time.Now()
+	status.silent = false
+	if !status.Available {
+		status.Available = true
+		logrus.Infof("[WORKER] %s is available", worker)
+		WriteWorkerAvailabilityToOutput(*status)
+	}
+	return status
+}
+
+// Heartbeat records a heartbeat of an agent.
+func (r *WorkerRegistry) Heartbeat(heartbeat protocol.Heartbeat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.seen(heartbeat.Worker)
+	status.Heartbeats++
+	status.Version = heartbeat.Version
+	status.Spooled = heartbeat.Spooled
+}
+
+// Event records a container event received from a worker.
+func (r *WorkerRegistry) Event(worker string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen(worker).Events++
+}
+
+// Check marks workers silent for longer than the timeout as unavailable.
+// Configured workers that never reported count from the controller's start.
+func (r *WorkerRegistry) Check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, status := range r.workers {
+		lastSeen := status.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = r.started
+		}
+		if status.silent || now.Sub(lastSeen) <= r.timeout {
+			continue
+		}
+		status.silent = true
+		status.Available = false
+		logrus.Warnf("[WORKER] %s is silent, last heard of %v ago", status.Worker, now.Sub(lastSeen).Round(time.Second))
+		WriteWorkerAvailabilityToOutput(*status)
+	}
+}
+
+// Watch checks the workers periodically until the context is cancelled.
+func (r *WorkerRegistry) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check()
+		}
+	}
+}
+
+// Workers returns a snapshot of all known workers sorted by name.
+func (r *WorkerRegistry) Workers() []WorkerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	workers := make([]WorkerStatus, 0, len(r.workers))
+	for _, status := range r.workers {
+		workers = append(workers, *status)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Worker < workers[j].Worker })
+	return workers
+}
+
+// WriteWorkerAvailabilityToOutput records a change of a worker's availability
+// so gaps in task data can be explained.
+func WriteWorkerAvailabilityToOutput(status WorkerStatus) {
+	header := []string{"Time", "Worker", "Available", "LastSeen", "Version", "Events"}
+	if err := aggregate.WriteCSV(filepath.Join(aggregate.OutputDir(), "worker_availability.csv"), header, []string{
+		aggregate.FormatTime(time.Now()),
+		status.Worker,
+		strconv.FormatBool(status.Available),
+		aggregate.FormatTime(status.LastSeen),
+		status.Version,
+		strconv.FormatInt(status.Events, 10),
+	}); err != nil {
+		logrus.Error("Error writing worker availability: ", err)
+	}
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/MA-DOS/LowLevelMonitoring/protocol"
+)
+
+func TestWorkerRegistryResolvesConfiguredNames(t *testing.T) {
+	previous := aggregate.OutputDir()
+	aggregate.SetOutputDir(t.TempDir())
+	defer aggregate.SetOutputDir(previous)
+	defer aggregate.OutputFiles.Close()
+
+	registry := NewWorkerRegistry([]string{"localhost", "10.0.0.1"}, time.Minute)
+	registry.Heartbeat(protocol.Heartbeat{Worker: "127.0.0.1", Version: "1.0"})
+	registry.Event("10.0.0.1")
+
+	workers := registry.Workers()
+	if len(workers) != 2 {
+		t.Fatalf("got workers %+v, want the two configured ones", workers)
+	}
+	for _, status := range workers {
+		if !status.Configured || !status.Available {
+			t.Errorf("got status %+v, want a configured, available worker", status)
+		}
+	}
+	if workers[1].Worker != "localhost" || workers[1].Heartbeats != 1 {
+		t.Errorf("got status %+v, want the heartbeat counted for localhost", workers[1])
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/MA-DOS/LowLevelMonitoring/client"
 	"github.com/sirupsen/logrus"
 )
@@ -15,6 +20,16 @@ func main() {
 		return
 	}
 
+	// Stop gracefully on Ctrl-C and SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Workers only forward their container events to the controller.
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		client.RunAgent(ctx, config)
+		return
+	}
+
 	// Start the monitoring loop.
-	client.ScheduleMonitoring(config, configFilePath)
+	client.ScheduleMonitoring(ctx, config, configFilePath)
 }
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// Sign sets the envelope's MAC to the HMAC-SHA256 of its header and payload.
+func (e *Envelope) Sign(secret []byte) {
+	e.MAC = hex.EncodeToString(e.mac(secret))
+}
+
+// Verify checks the envelope's MAC against the shared secret.
+func (e Envelope) Verify(secret []byte) error {
+	if e.MAC == "" {
+		return errors.New("missing message authentication code")
+	}
+	mac, err := hex.DecodeString(e.MAC)
+	if err != nil || !hmac.Equal(mac, e.mac(secret)) {
+		return errors.New("invalid message authentication code")
+	}
+	return nil
+}
+
+func (e Envelope) mac(secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strconv.Itoa(e.Version)))
+	h.Write([]byte{0})
+	h.Write([]byte(e.Type))
+	h.Write([]byte{0})
+	h.Write([]byte(e.ID))
+	h.Write([]byte{0})
+	h.Write(e.Payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,218 @@
+// Package protocol implements the newline-delimited JSON protocol agents use
+// to send container events to the controller. Every message is a versioned
+// envelope answered by exactly one response with the same ID.
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version of the envelope format. Receivers reject other versions.
+const Version = 1
+
+// Upper bound of a single encoded message.
+const MaxMessageSize = 4 << 20
+
+type MessageType string
+
+const (
+	TypeContainerEvent MessageType = "container_event"
+	TypeHeartbeat      MessageType = "heartbeat"
+)
+
+// Heartbeat is sent periodically by every agent.
+type Heartbeat struct {
+	Worker     string `json:"worker"`
+	Version    string `json:"version"`
+	EventsSent int64  `json:"events_sent"`
+	Spooled    int    `json:"spooled"`
+}
+
+// Envelope wraps every message sent from an agent to the controller.
+type Envelope struct {
+	Version int             `json:"version"`
+	Type    MessageType     `json:"type"`
+	ID      string          `json:"id"`
+	Sent    time.Time       `json:"sent"`
+	Payload json.RawMessage `json:"payload"`
+	MAC     string          `json:"mac,omitempty"` // HMAC-SHA256, see Sign.
+}
+
+type Status string
+
+const (
+	StatusAck   Status = "ack"   // Message accepted.
+	StatusNack  Status = "nack"  // Message understood but not accepted, the sender may retry.
+	StatusError Status = "error" // Message malformed or unsupported, retrying will not help.
+)
+
+// Response answers a single envelope.
+type Response struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Status  Status `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewEnvelope encodes the payload into an envelope of the given type.
+func NewEnvelope(messageType MessageType, id string, payload any) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("error encoding payload: %w", err)
+	}
+	return Envelope{
+		Version: Version,
+		Type:    messageType,
+		ID:      id,
+		Sent:    time.Now(),
+		Payload: data,
+	}, nil
+}
+
+// Decode unmarshals the envelope's payload into v.
+func (e Envelope) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Validate checks the envelope header.
+func (e Envelope) Validate() error {
+	if e.Version != Version {
+		return fmt.Errorf("unsupported protocol version %d", e.Version)
+	}
+	if e.ID == "" {
+		return errors.New("missing message id")
+	}
+	if len(e.Payload) == 0 {
+		return errors.New("missing payload")
+	}
+	return nil
+}
+
+// Conn reads and writes newline-delimited JSON messages on a connection.
+type Conn struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	mu      sync.Mutex // Serialises writes.
+}
+
+func NewConn(conn net.Conn) *Conn {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), MaxMessageSize)
+	return &Conn{
+		conn:    conn,
+		scanner: scanner,
+	}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// read decodes the next line into v.
+func (c *Conn) read(v any) error {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				return ErrTooLarge
+			}
+			return err
+		}
+		return errEOF
+	}
+	if err := json.Unmarshal(c.scanner.Bytes(), v); err != nil {
+		return &MalformedError{Err: err}
+	}
+	return nil
+}
+
+func (c *Conn) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) >= MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrTooLarge, len(data))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// ReadEnvelope reads the next envelope. A MalformedError leaves the connection
+// usable, any other error means it has to be closed. After ErrTooLarge the
+// receiver can still answer before closing.
+func (c *Conn) ReadEnvelope() (Envelope, error) {
+	var envelope Envelope
+	err := c.read(&envelope)
+	return envelope, err
+}
+
+func (c *Conn) WriteEnvelope(envelope Envelope) error {
+	return c.write(envelope)
+}
+
+func (c *Conn) ReadResponse() (Response, error) {
+	var response Response
+	err := c.read(&response)
+	return response, err
+}
+
+func (c *Conn) WriteResponse(response Response) error {
+	response.Version = Version
+	return c.write(response)
+}
+
+// Send writes the envelope and waits for its response.
+func (c *Conn) Send(envelope Envelope) (Response, error) {
+	if err := c.WriteEnvelope(envelope); err != nil {
+		return Response{}, err
+	}
+	response, err := c.ReadResponse()
+	if err != nil {
+		return Response{}, err
+	}
+	// Errors about the connection rather than a message carry no ID.
+	if response.ID != envelope.ID && !(response.ID == "" && response.Status == StatusError) {
+		return response, fmt.Errorf("response for message %s does not match %s", response.ID, envelope.ID)
+	}
+	return response, nil
+}
+
+// MalformedError reports a line that is not valid JSON.
+type MalformedError struct {
+	Err error
+}
+
+func (e *MalformedError) Error() string {
+	return "malformed message: " + e.Err.Error()
+}
+
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+var errEOF = errors.New("connection closed by peer")
+
+// ErrTooLarge reports a message of MaxMessageSize bytes or more. Such a
+// message can never be sent.
+var ErrTooLarge = fmt.Errorf("message exceeds the maximum of %d bytes", MaxMessageSize)
+
+// IsClosed reports whether the error means the peer closed the connection.
+func IsClosed(err error) bool {
+	return errors.Is(err, errEOF)
+}
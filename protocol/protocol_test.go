@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	sender, receiver := NewConn(client), NewConn(server)
+	defer sender.Close()
+	defer receiver.Close()
+
+	heartbeat := Heartbeat{Worker: "10.0.0.1", Version: "1.0", EventsSent: 3, Spooled: 1}
+	envelope, err := NewEnvelope(TypeHeartbeat, "10.0.0.1/heartbeat/1", heartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		received, err := receiver.ReadEnvelope()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := received.Validate(); err != nil {
+			t.Error(err)
+		}
+		var decoded Heartbeat
+		if err := received.Decode(&decoded); err != nil {
+			t.Error(err)
+		}
+		if decoded != heartbeat {
+			t.Errorf("got heartbeat %+v, want %+v", decoded, heartbeat)
+		}
+		receiver.WriteResponse(Response{ID: received.ID, Status: StatusAck})
+	}()
+
+	response, err := sender.Send(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != StatusAck || response.Version != Version {
+		t.Errorf("got response %+v, want a version %d ack", response, Version)
+	}
+}
+
+func TestConnMalformedMessage(t *testing.T) {
+	client, server := net.Pipe()
+	receiver := NewConn(server)
+	defer client.Close()
+	defer receiver.Close()
+
+	go client.Write([]byte("not json\n{\"version\":1,\"type\":\"heartbeat\",\"id\":\"x\",\"payload\":{}}\n"))
+
+	var malformed *MalformedError
+	if _, err := receiver.ReadEnvelope(); !errors.As(err, &malformed) {
+		t.Fatalf("got error %v, want a MalformedError", err)
+	}
+	// The connection stays usable.
+	envelope, err := receiver.ReadEnvelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.ID != "x" {
+		t.Errorf("got envelope %q, want x", envelope.ID)
+	}
+}
+
+func TestConnTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	sender, receiver := NewConn(client), NewConn(server)
+	defer sender.Close()
+	defer receiver.Close()
+
+	envelope, err := NewEnvelope(TypeContainerEvent, "id", strings.Repeat("x", MaxMessageSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(envelope); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("sending: got error %v, want ErrTooLarge", err)
+	}
+
+	// A peer that ignores the limit gets an error response without an ID.
+	go func() {
+		client.Write([]byte(strings.Repeat("x", MaxMessageSize+1)))
+	}()
+	if _, err := receiver.ReadEnvelope(); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("receiving: got error %v, want ErrTooLarge", err)
+	}
+	go receiver.WriteResponse(Response{Status: StatusError, Error: ErrTooLarge.Error()})
+	response, err := sender.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != StatusError {
+		t.Errorf("got status %q, want %q", response.Status, StatusError)
+	}
+}
+
+func TestEnvelopeValidate(t *testing.T) {
+	valid, _ := NewEnvelope(TypeHeartbeat, "id", Heartbeat{})
+	tests := []struct {
+		name   string
+		modify func(*Envelope)
+		valid  bool
+	}{
+		{"valid", func(*Envelope) {}, true},
+		{"other version", func(e *Envelope) { e.Version = Version + 1 }, false},
+		{"missing id", func(e *Envelope) { e.ID = "" }, false},
+		{"missing payload", func(e *Envelope) { e.Payload = nil }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope := valid
+			test.modify(&envelope)
+			if err := envelope.Validate(); (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestEnvelopeMAC(t *testing.T) {
+	secret := []byte("secret")
+	signed, _ := NewEnvelope(TypeContainerEvent, "id", map[string]string{"name": "nxf-task"})
+	signed.Sign(secret)
+
+	tests := []struct {
+		name   string
+		modify func(*Envelope)
+		secret []byte
+		valid  bool
+	}{
+		{"signed", func(*Envelope) {}, secret, true},
+		{"wrong secret", func(*Envelope) {}, []byte("other"), false},
+		{"missing mac", func(e *Envelope) { e.MAC = "" }, secret, false},
+		{"mac not hex", func(e *Envelope) { e.MAC = "zz" }, secret, false},
+		{"payload changed", func(e *Envelope) { e.Payload = []byte(`{"name":"other"}`) }, secret, false},
+		{"id changed", func(e *Envelope) { e.ID = "other" }, secret, false},
+		{"type changed", func(e *Envelope) { e.Type = TypeHeartbeat }, secret, false},
+		// The send time is not covered, re-sent envelopes keep their MAC.
+		{"resent", func(e *Envelope) { e.Sent = e.Sent.Add(1) }, secret, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope := signed
+			test.modify(&envelope)
+			if err := envelope.Verify(test.secret); (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -2,16 +2,16 @@ package watcher
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
@@ -32,9 +32,60 @@ type NextflowContainer struct {
 	PID            int       `json:"pid"`
 	ContainerID    string    `json:"container_id"`
 	WorkDir        string    `json:"work_dir"`
+
+	// Exit status, known once the container died.
+	ExitCode    int    `json:"exit_code"`
+	OOMKilled   bool   `json:"oom_killed"`
+	Error       string `json:"error,omitempty"`
+	DieExitCode string `json:"die_exit_code,omitempty"` // exitCode attribute of the die event.
+
+	Limits ResourceLimits `json:"limits"`
+
+	// Task metadata from the container and image inspection.
+	Image             string            `json:"image,omitempty"`
+	ImageID           string            `json:"image_id,omitempty"`
+	ImageDigest       string            `json:"image_digest,omitempty"`
+	Entrypoint        []string          `json:"entrypoint,omitempty"`
+	Cmd               []string          `json:"cmd,omitempty"`
+	Hostname          string            `json:"hostname,omitempty"`           // Host of the watcher that saw the container.
+	ContainerHostname string            `json:"container_hostname,omitempty"` // Hostname inside the container.
+	Labels            map[string]string `json:"labels,omitempty"`
+	Env               map[string]string `json:"env,omitempty"`
+
+	Events []LifecycleEvent `json:"events,omitempty"`
+}
+
+// Task status values derived from the exit status.
+const (
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskOOMKilled = "oom_killed"
+)
+
+// Failed reports whether the task in the container did not exit cleanly.
+func (c NextflowContainer) Failed() bool {
+	return c.ExitCode != 0 || c.OOMKilled || (c.DieExitCode != "" && c.DieExitCode != "0")
 }
 
-func (c *NextflowContainer) GetContainerEvents(containerEventChannel chan<- NextflowContainer) {
+// Status summarises the exit status of the task.
+func (c NextflowContainer) Status() string {
+	switch {
+	case c.OOMKilled:
+		return TaskOOMKilled
+	case c.Failed():
+		return TaskFailed
+	}
+	return TaskSucceeded
+}
+
+// GetContainerEvents watches the local Docker daemon and sends every started
+// and died Nextflow container to the channel. It returns once the context is
+// cancelled and all in-flight inspections and stats collectors finished, and
+// closes the channel. Events missed during shutdown are recovered from the
+// lifecycle state on the next start.
+func (c *NextflowContainer) GetContainerEvents(ctx context.Context, opts WatchOptions, lifecycle *Lifecycle, containerEventChannel chan<- NextflowContainer) {
+	defer close(containerEventChannel)
+
 	// Container Client.
 	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.49"))
 	if err != nil {
@@ -42,155 +93,212 @@ func (c *NextflowContainer) GetContainerEvents(containerEventChannel chan<- Next
 	}
 	defer apiClient.Close()
 
-	eventChan, errChan := apiClient.Events(context.Background(), events.ListOptions{})
+	eventChan, errChan := apiClient.Events(ctx, events.ListOptions{})
 
-	processedStarts := make(map[string]bool) // Track started containers
-	processedDies := make(map[string]bool)   // Track died containers
-	containerPIDs := make(map[string]int)    // Track container PIDs
-	var mu sync.Mutex
 	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	// Pick up containers that were started before the monitor restarted.
+	resumeStartedContainers(ctx, apiClient, opts, lifecycle, containerEventChannel, &wg)
 
-	go func() {
-		for {
-			select {
-			case event := <-eventChan:
-				if event.Type == events.ContainerEventType {
-					switch event.Action {
-					case "start":
-						processContainerEvent(event, apiClient, re, &mu, processedStarts, containerPIDs, containerEventChannel, true, &wg)
-					case "die":
-						processContainerEvent(event, apiClient, re, &mu, processedDies, containerPIDs, containerEventChannel, false, &wg)
-					}
-				}
-			case err := <-errChan:
-				if err != nil {
-					logrus.Error("Error while watching for events: ", err)
-				}
+	// Events of a container are handled in order, so a short task's die is
+	// never applied before its start.
+	queues := newContainerQueues(&wg)
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Info("Stopped watching container events")
+			return
+		case event := <-eventChan:
+			if event.Type != events.ContainerEventType || !isNextflowEvent(event) {
+				continue
+			}
+			queues.Run(event.Actor.ID, func() {
+				handleContainerEvent(ctx, event, apiClient, opts, lifecycle, containerEventChannel, &wg)
+			})
+		case err := <-errChan:
+			if err != nil && ctx.Err() == nil {
+				logrus.Error("Error while watching for events: ", err)
 			}
 		}
-	}()
-	wg.Wait()
+	}
 }
 
-func processContainerEvent(event events.Message, apiClient *client.Client, re *regexp.Regexp, mu *sync.Mutex, processed map[string]bool, containerPIDs map[string]int, containerEventChannel chan<- NextflowContainer, isStartEvent bool, wg *sync.WaitGroup) {
-	mu.Lock()
-	if processed[event.Actor.ID] {
-		mu.Unlock()
-		return
+// handleContainerEvent applies a Docker event of a Nextflow container.
+func handleContainerEvent(ctx context.Context, event events.Message, apiClient *client.Client, opts WatchOptions, lifecycle *Lifecycle, containerEventChannel chan<- NextflowContainer, wg *sync.WaitGroup) {
+	// Create the record first so the create event can be attached to it.
+	if event.Action == events.ActionCreate {
+		transitionFromEvent(lifecycle, StateCreated, event)
 	}
-	processed[event.Actor.ID] = true
-	mu.Unlock()
+	if isRecordedAction(event.Action) {
+		lifecycleEvent := newLifecycleEvent(event)
+		WriteEventToOutput(event.Actor.Attributes["name"], event.Actor.ID, lifecycleEvent)
+		lifecycle.RecordEvent(event.Actor.ID, lifecycleEvent)
+	}
+	switch event.Action {
+	case events.ActionStart:
+		processContainerEvent(ctx, event, apiClient, opts, lifecycle, containerEventChannel, true, wg)
+	case events.ActionPause:
+		transitionFromEvent(lifecycle, StatePaused, event)
+	case events.ActionUnPause:
+		transitionFromEvent(lifecycle, StateStarted, event)
+	case events.ActionDie:
+		processContainerEvent(ctx, event, apiClient, opts, lifecycle, containerEventChannel, false, wg)
+	case events.ActionDestroy:
+		transitionFromEvent(lifecycle, StateEvicted, event)
+	}
+}
 
-	go func() {
-		// Get container metadata for prometheus queries.
-		containerInfo, err := apiClient.ContainerInspect(context.Background(), event.Actor.ID)
-		if err != nil {
-			logrus.Printf("Error inspecting container %s: %v", event.Actor.ID, err)
-			return
+// isNextflowEvent filters events by the container name Docker attaches to them.
+func isNextflowEvent(event events.Message) bool {
+	return re.MatchString("/" + event.Actor.Attributes["name"])
+}
+
+// transitionFromEvent applies a state change that needs no container inspection.
+func transitionFromEvent(lifecycle *Lifecycle, to LifecycleState, event events.Message) {
+	container := NextflowContainer{
+		Name:        event.Actor.Attributes["name"],
+		ContainerID: event.Actor.ID,
+	}
+	if _, err := lifecycle.Transition(to, container); err != nil {
+		logrus.Debug(err)
+	}
+}
+
+// resumeStartedContainers checks local containers recorded as started before a
+// restart and finishes those that died while the monitor was down.
+func resumeStartedContainers(ctx context.Context, apiClient *client.Client, opts WatchOptions, lifecycle *Lifecycle, containerEventChannel chan<- NextflowContainer, wg *sync.WaitGroup) {
+	for _, started := range lifecycle.Containers(StateStarted) {
+		if started.WorkerIP != opts.WorkerIP {
+			// Remote containers are finished by their agent.
+			continue
 		}
 
-		if len(containerInfo.Name) > 0 && re.MatchString(containerInfo.Name) {
-			eventType := "[STARTED]"
-			if !isStartEvent {
-				eventType = "[DIED]"
-			}
-			logrus.Infof("%s nextflow container: %s\n", eventType, containerInfo.Name)
-			pid := containerInfo.State.Pid
-
-			// wg.Add(1)
-			// go func() {
-			// 	defer wg.Done()
-			// 	getContainerStats(apiClient, containerInfo.ID, containerInfo.Name)
-			// }()
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				getContainerStatsManual(apiClient, containerInfo.ID, containerInfo.Name)
-			}()
-
-			if !isStartEvent {
-				mu.Lock()
-				pid = containerPIDs[event.Actor.ID]
-				if pid == 0 {
-					logrus.Warn("Container Process interrupted, PID not found")
-					return
-				}
-				mu.Unlock()
-			}
+		containerInfo, err := apiClient.ContainerInspect(ctx, started.ContainerID)
+		var died NextflowContainer
+		switch {
+		case err != nil:
+			logrus.Warnf("Container %s vanished while the monitor was down, using current time as die time", started.Name)
+			died = started
+			died.DieTime = time.Now()
+			died.LifeTime = died.DieTime.Sub(died.StartTime).String()
+		case containerInfo.State.Running:
+			logrus.Infof("[RESUMED] nextflow container: %s is still running", started.Name)
+			continue
+		default:
+			died = createNextflowContainer(containerInfo, started.PID)
+			addMetadata(ctx, &died, apiClient, containerInfo, opts)
+		}
 
-			nextflowContainer := createNextflowContainer(containerInfo, pid)
-
-			if isStartEvent {
-				mu.Lock()
-				containerPIDs[event.Actor.ID] = pid
-				mu.Unlock()
-				WriteStartedToOutput(nextflowContainer)
-			} else {
-				mu.Lock()
-				pid = containerPIDs[event.Actor.ID]
-				if pid == 0 {
-					logrus.Warn("Container Process interrupted, PID not found")
-					return
-				}
-				mu.Unlock()
-				containerEventChannel <- nextflowContainer
-				WriteDiedToOutput(nextflowContainer)
-			}
+		logrus.Infof("[RESUMED] nextflow container: %s died while the monitor was down", died.Name)
+		died.ContainerEvent = "[DIED]"
+		died, err = lifecycle.Transition(StateDied, died)
+		if err != nil {
+			logrus.Warn(err)
+			continue
 		}
-	}()
+		wg.Add(1)
+		go func(died NextflowContainer) {
+			defer wg.Done()
+			containerEventChannel <- died
+		}(died)
+	}
 }
 
-func getContainerStats(apiClient *client.Client, containerID, containerName string) {
-	ctx := context.Background()
-	containerStats, err := apiClient.ContainerStats(ctx, containerID, true)
-	if err != nil {
-		logrus.Errorf("Error inspecting container %s: %v", containerID, err)
-		return
+// processContainerEvent inspects a started or died container and moves it
+// through its lifecycle.
+func processContainerEvent(ctx context.Context, event events.Message, apiClient *client.Client, opts WatchOptions, lifecycle *Lifecycle, containerEventChannel chan<- NextflowContainer, isStartEvent bool, wg *sync.WaitGroup) {
+	eventType := "[STARTED]"
+	state := StateStarted
+	if !isStartEvent {
+		eventType = "[DIED]"
+		state = StateDied
 	}
-	defer containerStats.Body.Close()
 
-	if _, err := os.Stat("results"); os.IsNotExist(err) {
-		logrus.Errorf("Results directory does not exist, not writing stats for %s", containerName)
+	// Get container metadata for prometheus queries.
+	var nextflowContainer NextflowContainer
+	containerInfo, err := apiClient.ContainerInspect(ctx, event.Actor.ID)
+	switch {
+	case err == nil:
+		if len(containerInfo.Name) == 0 || !re.MatchString(containerInfo.Name) {
+			return
+		}
+		// The PID is only known while the container runs, a dead container
+		// takes it over from its started record.
+		nextflowContainer = createNextflowContainer(containerInfo, containerInfo.State.Pid)
+		addMetadata(ctx, &nextflowContainer, apiClient, containerInfo, opts)
+		if !isStartEvent {
+			nextflowContainer.PID = 0
+		}
+	case isStartEvent:
+		logrus.Errorf("Error inspecting container %s: %v", event.Actor.ID, err)
 		return
+	default:
+		// Containers run with --rm are usually gone by the time the die
+		// event is handled.
+		var known bool
+		if nextflowContainer, known = lifecycle.Container(event.Actor.ID); !known {
+			logrus.Warnf("Container %s died before it could be inspected: %v", event.Actor.Attributes["name"], err)
+			return
+		}
+		nextflowContainer = diedFromEvent(nextflowContainer, event)
 	}
-	statsFileName := fmt.Sprintf("results/%s.json", containerName)
-	// statsFile, err := os.Create(statsFileName)
-	statsFile, err := os.OpenFile(statsFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if !isStartEvent {
+		nextflowContainer.DieExitCode = event.Actor.Attributes["exitCode"]
+	}
+	nextflowContainer.ContainerEvent = eventType
+	nextflowContainer, err = lifecycle.Transition(state, nextflowContainer)
 	if err != nil {
-		logrus.Errorf("Error creating stats file: %v", err)
-	} else {
-		defer statsFile.Close()
-		decoder := json.NewDecoder(containerStats.Body)
-		encoder := json.NewEncoder(statsFile)
-
-		for {
-			var stats container.StatsResponse
-			if err := decoder.Decode(&stats); err != nil {
-				if err == io.EOF {
-					break
-				}
-				logrus.Errorf("Error decoding container stats: %v", err)
-				break
-			}
-			if err := encoder.Encode(stats); err != nil {
-				logrus.Errorf("Error writing stats to file: %v", err)
-				break
-			}
-		}
+		// Duplicate or out-of-order event.
+		logrus.Debug(err)
+		return
+	}
+	logrus.Infof("%s nextflow container: %s\n", eventType, nextflowContainer.Name)
+
+	if isStartEvent {
+		// Docker stats are only reachable on the worker, so agents keep them
+		// in their local results directory.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			getContainerStatsManual(ctx, apiClient, containerInfo.ID, containerInfo.Name)
+		}()
+		containerEventChannel <- nextflowContainer
+		return
 	}
-	containerStats.Body.Close()
+
+	// Without a PID only the PID-based queries are skipped.
+	containerEventChannel <- nextflowContainer
 }
 
-func getContainerStatsManual(apiClient *client.Client, containerID, containerName string) {
-	ctx := context.Background()
-	statsFileName := fmt.Sprintf("results/%s.json", containerName)
-	statsFile, err := os.OpenFile(statsFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// diedFromEvent completes the known details of a container that could not be
+// inspected anymore with the attributes of its die event.
+func diedFromEvent(known NextflowContainer, event events.Message) NextflowContainer {
+	died := known
+	died.PID = 0
+	died.DieTime = time.Unix(0, event.TimeNano)
+	if !died.StartTime.IsZero() {
+		died.LifeTime = died.DieTime.Sub(died.StartTime).String()
+	}
+	if exitCode, err := strconv.Atoi(event.Actor.Attributes["exitCode"]); err == nil {
+		died.ExitCode = exitCode
+	}
+	return died
+}
+
+// writeStats appends the stats as a JSON line through the output file cache,
+// which compresses and rotates the file as configured.
+func writeStats(fileName string, stats container.StatsResponse) error {
+	data, err := json.Marshal(stats)
 	if err != nil {
-		logrus.Errorf("Error creating stats file: %v", err)
-		return
+		return err
 	}
-	defer statsFile.Close()
-	encoder := json.NewEncoder(statsFile)
+	return aggregate.OutputFiles.Write(fileName, append(data, '\n'))
+}
+
+func getContainerStatsManual(ctx context.Context, apiClient *client.Client, containerID, containerName string) {
+	statsFileName := fmt.Sprintf("%s/%s.json", aggregate.OutputDir(), containerName)
+	defer aggregate.OutputFiles.CloseFile(statsFileName)
 
 	for {
 		containerStats, err := apiClient.ContainerStats(ctx, containerID, false)
@@ -206,7 +314,7 @@ func getContainerStatsManual(apiClient *client.Client, containerID, containerNam
 			break
 		}
 		containerStats.Body.Close()
-		if err := encoder.Encode(stats); err != nil {
+		if err := writeStats(statsFileName, stats); err != nil {
 			logrus.Errorf("Error writing stats to file: %v", err)
 			break
 		}
@@ -216,7 +324,11 @@ func getContainerStatsManual(apiClient *client.Client, containerID, containerNam
 		if err != nil || !inspect.State.Running {
 			break
 		}
-		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
 	}
 }
 
@@ -239,76 +351,63 @@ func createNextflowContainer(containerInfo types.ContainerJSON, pid int) Nextflo
 		PID:         pid,
 		ContainerID: containerInfo.ID,
 		WorkDir:     containerInfo.Config.WorkingDir,
+		ExitCode:    containerInfo.State.ExitCode,
+		OOMKilled:   containerInfo.State.OOMKilled,
+		Error:       containerInfo.State.Error,
+		Limits:      newResourceLimits(containerInfo.HostConfig),
 	}
 }
 
-func WriteStartedToOutput(container NextflowContainer) {
-	fullPath := prepareOutputFile("results", "started_nextflow_containers.csv")
+func WriteStartedToOutput(container NextflowContainer, opts MetadataOptions) {
+	fullPath := prepareOutputFile(aggregate.OutputDir(), "started_nextflow_containers.csv")
 	if fullPath == "" {
 		return
 	}
 
-	file, err := os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		logrus.Error("Error opening file: ", err)
-		return
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write CSV header if the file is empty
-	if isFileEmpty(file) {
-		if err := writer.Write([]string{"Name", "PID", "ContainerID", "WorkDir"}); err != nil {
-			logrus.Error("Error writing CSV header: ", err)
-			return
-		}
-	}
+	header := append([]string{"SchemaVersion", "Name", "PID", "ContainerID", "WorkDir", "StartTime"}, metadataHeader(opts)...)
 
 	// Write container data to CSV
-	if err := writer.Write([]string{
+	record := append([]string{
+		LifecycleSchemaVersion,
 		container.Name,
 		fmt.Sprintf("%d", container.PID),
 		container.ContainerID,
 		container.WorkDir,
-	}); err != nil {
+		formatTime(container.StartTime),
+	}, metadataRecord(container, opts)...)
+	if err := aggregate.WriteVersionedCSV(fullPath, header, record); err != nil {
 		logrus.Error("Error writing container data to CSV: ", err)
 	}
 }
 
-func WriteDiedToOutput(container NextflowContainer) {
-	fullPath := prepareOutputFile("results", "died_nextflow_containers.csv")
+func WriteDiedToOutput(container NextflowContainer, opts MetadataOptions) {
+	fullPath := prepareOutputFile(aggregate.OutputDir(), "died_nextflow_containers.csv")
 	if fullPath == "" {
 		return
 	}
 
-	file, err := os.OpenFile(fullPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		logrus.Error("Error opening file: ", err)
-		return
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write CSV header if the file is empty
-	if isFileEmpty(file) {
-		if err := writer.Write([]string{"Name", "PID", "ContainerID", "WorkDir", "LifeTime"}); err != nil {
-			logrus.Error("Error writing CSV header: ", err)
-			return
-		}
-	}
+	header := append([]string{"SchemaVersion", "Name", "PID", "ContainerID", "WorkDir", "StartTime", "DieTime", "LifeTime",
+		"Status", "ExitCode", "OOMKilled", "Error", "DieExitCode", "AllocatedCPUs", "MemoryLimit"}, metadataHeader(opts)...)
 
 	// Write container data to CSV
-	if err := writer.Write([]string{
+	record := append([]string{
+		LifecycleSchemaVersion,
 		container.Name,
 		fmt.Sprintf("%d", container.PID),
 		container.ContainerID,
 		container.WorkDir,
+		formatTime(container.StartTime),
+		formatTime(container.DieTime),
 		container.LifeTime,
-	}); err != nil {
+		container.Status(),
+		strconv.Itoa(container.ExitCode),
+		strconv.FormatBool(container.OOMKilled),
+		container.Error,
+		container.DieExitCode,
+		strconv.FormatFloat(container.Limits.AllocatedCPUs(), 'f', -1, 64),
+		strconv.FormatInt(container.Limits.Memory, 10),
+	}, metadataRecord(container, opts)...)
+	if err := aggregate.WriteVersionedCSV(fullPath, header, record); err != nil {
 		logrus.Error("Error writing container data to CSV: ", err)
 	}
 }
@@ -326,15 +425,6 @@ func prepareOutputFile(path, fileName string) string {
 	return fullPath
 }
 
-func isFileEmpty(file *os.File) bool {
-	fileInfo, err := file.Stat()
-	if err != nil {
-		logrus.Error("Error getting file info: ", err)
-		return false
-	}
-	return fileInfo.Size() == 0
-}
-
 func EscapeContainerName(containerName string) string {
 	// Remove the leading '/' if present
 	containerName = strings.TrimPrefix(containerName, "/")
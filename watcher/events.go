@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/docker/docker/api/types/events"
+	"github.com/sirupsen/logrus"
+)
+
+// Upper bound of events kept per container, older ones are dropped first.
+const maxEventsPerContainer = 256
+
+// LifecycleEvent is a timestamped Docker event of a container.
+type LifecycleEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Signal   string    `json:"signal,omitempty"`
+	ExitCode string    `json:"exit_code,omitempty"`
+}
+
+func newLifecycleEvent(event events.Message) LifecycleEvent {
+	return LifecycleEvent{
+		Time:     time.Unix(0, event.TimeNano),
+		Action:   string(event.Action),
+		Signal:   event.Actor.Attributes["signal"],
+		ExitCode: event.Actor.Attributes["exitCode"],
+	}
+}
+
+// isRecordedAction reports whether the action is kept in the events log.
+func isRecordedAction(action events.Action) bool {
+	switch action {
+	case events.ActionCreate, events.ActionStart, events.ActionRestart,
+		events.ActionPause, events.ActionUnPause, events.ActionKill,
+		events.ActionOOM, events.ActionDie, events.ActionDestroy:
+		return true
+	}
+	return false
+}
+
+// RecordEvent attaches the event to the container's record so it travels with
+// the container to the output. Events of unknown containers are dropped.
+func (l *Lifecycle) RecordEvent(containerID string, event LifecycleEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, ok := l.records[containerID]
+	if !ok {
+		return
+	}
+	record.Container.Events = append(record.Container.Events, event)
+	if len(record.Container.Events) > maxEventsPerContainer {
+		record.Container.Events = record.Container.Events[len(record.Container.Events)-maxEventsPerContainer:]
+	}
+}
+
+// WriteEventToOutput appends a single event to the global events log.
+func WriteEventToOutput(name, containerID string, event LifecycleEvent) {
+	fullPath := prepareOutputFile(aggregate.OutputDir(), "container_events.csv")
+	if fullPath == "" {
+		return
+	}
+	writeEvents(fullPath, []string{"Time", "Name", "ContainerID", "Action", "Signal", "ExitCode"}, [][]string{
+		{formatTime(event.Time), name, containerID, event.Action, event.Signal, event.ExitCode},
+	})
+}
+
+// WriteTaskEventsToOutput writes all events of a finished container into its
+// own file next to the task's metric output. The file is named like the
+// task's output so retries of a task under the same name are kept apart.
+func WriteTaskEventsToOutput(container NextflowContainer) {
+	if len(container.Events) == 0 {
+		return
+	}
+	name := aggregate.TaskPathName(aggregate.TaskInfo{Name: container.Name, ContainerID: container.ContainerID})
+	fullPath := filepath.Join(aggregate.OutputDir(), "task_events", name+".csv")
+	records := make([][]string, 0, len(container.Events))
+	for _, event := range container.Events {
+		records = append(records, []string{formatTime(event.Time), event.Action, event.Signal, event.ExitCode})
+	}
+	writeEvents(fullPath, []string{"Time", "Action", "Signal", "ExitCode"}, records)
+	// The task is complete, there is no need to keep its file open.
+	if err := aggregate.OutputFiles.CloseFile(fullPath); err != nil {
+		logrus.Error("Error closing task events: ", err)
+	}
+}
+
+func writeEvents(fullPath string, header []string, records [][]string) {
+	if err := aggregate.WriteCSV(fullPath, header, records...); err != nil {
+		logrus.Error("Error writing events to CSV: ", err)
+	}
+}
@@ -0,0 +1,278 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LifecycleState is the position of a container in its lifecycle.
+type LifecycleState string
+
+const (
+	StateCreated   LifecycleState = "created"
+	StateStarted   LifecycleState = "started"
+	StatePaused    LifecycleState = "paused"
+	StateDied      LifecycleState = "died"
+	StateProcessed LifecycleState = "processed"
+	StateEvicted   LifecycleState = "evicted"
+)
+
+// Allowed transitions. Died and processed containers may start again, which
+// is how Docker reports a restart of the same container ID. Died containers
+// cannot be evicted before their results are written. A container may be
+// first seen dead when its start event was missed, and a container destroyed
+// without a die event is evicted from any running state.
+var transitions = map[LifecycleState][]LifecycleState{
+	"":             {StateCreated, StateStarted, StateDied},
+	StateCreated:   {StateStarted, StateDied, StateEvicted},
+	StateStarted:   {StatePaused, StateDied, StateEvicted},
+	StatePaused:    {StateStarted, StateDied, StateEvicted},
+	StateDied:      {StateStarted, StateProcessed},
+	StateProcessed: {StateStarted, StateEvicted},
+}
+
+// ErrProcessed reports a die event of a container run that was processed
+// already, e.g. one re-sent by an agent.
+var ErrProcessed = errors.New("container was processed already")
+
+// ContainerRecord holds everything known about one container.
+type ContainerRecord struct {
+	State      LifecycleState    `json:"state"`
+	Generation int               `json:"generation"` // Incremented every time the container (re)starts.
+	Container  NextflowContainer `json:"container"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// Lifecycle tracks the state of every known container. Records are evicted once
+// their results are written so memory stays bounded over long campaigns.
+type Lifecycle struct {
+	mu      sync.Mutex
+	records map[string]*ContainerRecord
+	evicted int
+	store   *StateStore
+	recent  []ContainerRecord // Last evicted records after processing, oldest first.
+}
+
+// Number of processed containers kept for inspection after eviction.
+const recentCapacity = 500
+
+// NewLifecycle creates a tracker and restores the unfinished and recently
+// processed containers recorded in the state store.
+func NewLifecycle(store *StateStore) *Lifecycle {
+	l := &Lifecycle{
+		records: make(map[string]*ContainerRecord),
+		store:   store,
+	}
+	if store != nil {
+		for _, entry := range store.Entries() {
+			l.records[entry.ContainerID] = &ContainerRecord{
+				State:      entry.State,
+				Generation: 1,
+				Container:  entry.Container,
+				UpdatedAt:  entry.Time,
+			}
+		}
+		for _, entry := range store.Processed() {
+			l.recent = append(l.recent, ContainerRecord{
+				State:      StateProcessed,
+				Generation: 1,
+				Container:  entry.Container,
+				UpdatedAt:  entry.Time,
+			})
+		}
+	}
+	return l
+}
+
+func canTransition(from, to LifecycleState) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the container to the given state and persists it. Details
+// missing in container (e.g. the PID, which is gone once a container died) are
+// taken over from the existing record. It returns the updated container.
+func (l *Lifecycle) Transition(to LifecycleState, container NextflowContainer) (NextflowContainer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.transition(to, container)
+}
+
+func (l *Lifecycle) transition(to LifecycleState, container NextflowContainer) (NextflowContainer, error) {
+	id := container.ContainerID
+	record, exists := l.records[id]
+	from := LifecycleState("")
+	if exists {
+		from = record.State
+	}
+	if !canTransition(from, to) {
+		return container, fmt.Errorf("invalid transition for container %s: %q -> %q", id, from, to)
+	}
+	if !exists && to == StateDied && l.processed(container) {
+		return container, fmt.Errorf("container %s died at %v: %w", id, container.DieTime, ErrProcessed)
+	}
+
+	if !exists {
+		record = &ContainerRecord{}
+		l.records[id] = record
+	}
+	if to == StateStarted && from != StatePaused {
+		record.Generation++
+		if record.Generation > 1 {
+			logrus.Infof("[RESTARTED] container %s (generation %d)", container.Name, record.Generation)
+		}
+	}
+	mergeContainer(&container, record.Container)
+
+	record.State = to
+	record.Container = container
+	record.UpdatedAt = time.Now()
+
+	if err := l.store.Record(to, container); err != nil {
+		logrus.Error("Error recording container state: ", err)
+	}
+	if to == StateEvicted {
+		if from == StateProcessed {
+			l.recent = append(l.recent, ContainerRecord{
+				State:      StateProcessed,
+				Generation: record.Generation,
+				Container:  container,
+				UpdatedAt:  record.UpdatedAt,
+			})
+			if len(l.recent) > recentCapacity {
+				l.recent = l.recent[len(l.recent)-recentCapacity:]
+			}
+		}
+		delete(l.records, id)
+		l.evicted++
+	}
+	return container, nil
+}
+
+// processed reports whether this run of the container was processed and
+// evicted already, so a repeated die event is not processed twice.
+func (l *Lifecycle) processed(container NextflowContainer) bool {
+	for _, recent := range l.recent {
+		if recent.Container.ContainerID == container.ContainerID && !container.DieTime.After(recent.Container.DieTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeContainer fills empty fields of c from the previously known details.
+func mergeContainer(c *NextflowContainer, known NextflowContainer) {
+	if c.PID == 0 {
+		c.PID = known.PID
+	}
+	if c.Name == "" {
+		c.Name = known.Name
+	}
+	if c.WorkerIP == "" {
+		c.WorkerIP = known.WorkerIP
+	}
+	if c.WorkDir == "" {
+		c.WorkDir = known.WorkDir
+	}
+	if c.StartTime.IsZero() {
+		c.StartTime = known.StartTime
+	}
+	if len(c.Events) == 0 {
+		c.Events = known.Events
+	}
+}
+
+// Finish marks the container as processed and evicts its record. A container
+// that restarted meanwhile keeps its record for the running generation.
+func (l *Lifecycle) Finish(container NextflowContainer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record, ok := l.records[container.ContainerID]; ok && (record.State == StateStarted || record.State == StatePaused) {
+		logrus.Infof("Container %s restarted before its previous run was processed, keeping its record", container.Name)
+		return
+	}
+	for _, state := range []LifecycleState{StateProcessed, StateEvicted} {
+		if _, err := l.transition(state, container); err != nil {
+			logrus.Warn(err)
+			return
+		}
+	}
+}
+
+// Container returns the known details of a container.
+func (l *Lifecycle) Container(containerID string) (NextflowContainer, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, ok := l.records[containerID]
+	if !ok {
+		return NextflowContainer{}, false
+	}
+	return record.Container, true
+}
+
+// Containers returns the containers currently in the given state.
+func (l *Lifecycle) Containers(state LifecycleState) []NextflowContainer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var containers []NextflowContainer
+	for _, record := range l.records {
+		if record.State == state {
+			containers = append(containers, record.Container)
+		}
+	}
+	return containers
+}
+
+// Records returns a copy of the records in the given states.
+func (l *Lifecycle) Records(states ...LifecycleState) []ContainerRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var records []ContainerRecord
+	for _, record := range l.records {
+		for _, state := range states {
+			if record.State == state {
+				records = append(records, *record)
+			}
+		}
+	}
+	return records
+}
+
+// Recent returns the most recently processed and evicted containers.
+func (l *Lifecycle) Recent() []ContainerRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ContainerRecord(nil), l.recent...)
+}
+
+// Counts returns how many containers are in each state. Evicted is the total
+// number of records dropped since the tracker was created.
+func (l *Lifecycle) Counts() map[LifecycleState]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := map[LifecycleState]int{
+		StateCreated:   0,
+		StateStarted:   0,
+		StatePaused:    0,
+		StateDied:      0,
+		StateProcessed: 0,
+		StateEvicted:   l.evicted,
+	}
+	for _, record := range l.records {
+		counts[record.State]++
+	}
+	return counts
+}
@@ -0,0 +1,150 @@
+package watcher
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleTransitions(t *testing.T) {
+	died := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		steps []LifecycleState
+		want  LifecycleState // "" if the record was evicted.
+	}{
+		{"short task dies before it is seen started", []LifecycleState{StateCreated, StateDied}, StateDied},
+		{"destroy evicts a started container", []LifecycleState{StateCreated, StateStarted, StateEvicted}, ""},
+		{"destroy evicts a paused container", []LifecycleState{StateStarted, StatePaused, StateEvicted}, ""},
+		{"restart after processing", []LifecycleState{StateStarted, StateDied, StateProcessed, StateStarted}, StateStarted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lifecycle := NewLifecycle(nil)
+			container := NextflowContainer{ContainerID: "id", Name: "nxf-task", DieTime: died}
+			for _, step := range test.steps {
+				if _, err := lifecycle.Transition(step, container); err != nil {
+					t.Fatal(err)
+				}
+			}
+			record, ok := lifecycle.Container("id")
+			if test.want == "" {
+				if ok {
+					t.Fatalf("record %v was not evicted", record)
+				}
+				return
+			}
+			if counts := lifecycle.Counts(); counts[test.want] != 1 {
+				t.Errorf("got counts %v, want one container %q", counts, test.want)
+			}
+		})
+	}
+}
+
+func TestLifecycleRejectsInvalidTransitions(t *testing.T) {
+	lifecycle := NewLifecycle(nil)
+	container := NextflowContainer{ContainerID: "id"}
+	lifecycle.Transition(StateStarted, container)
+	lifecycle.Transition(StateDied, container)
+	if _, err := lifecycle.Transition(StateEvicted, container); err == nil {
+		t.Error("a died container was evicted before its results were written")
+	}
+}
+
+func TestLifecycleFinishAfterRestart(t *testing.T) {
+	lifecycle := NewLifecycle(nil)
+	first := NextflowContainer{ContainerID: "id", DieTime: time.Unix(100, 0)}
+	lifecycle.Transition(StateStarted, first)
+	lifecycle.Transition(StateDied, first)
+
+	// Docker restarts the container before its first run is processed.
+	lifecycle.Transition(StateStarted, NextflowContainer{ContainerID: "id"})
+	lifecycle.Finish(first)
+	if counts := lifecycle.Counts(); counts[StateStarted] != 1 {
+		t.Fatalf("got counts %v, want the restarted container kept", counts)
+	}
+
+	second := NextflowContainer{ContainerID: "id", DieTime: time.Unix(200, 0)}
+	if _, err := lifecycle.Transition(StateDied, second); err != nil {
+		t.Fatal(err)
+	}
+	lifecycle.Finish(second)
+	if _, ok := lifecycle.Container("id"); ok {
+		t.Error("record of the second run was not evicted")
+	}
+}
+
+func TestLifecycleRejectsRepeatedDie(t *testing.T) {
+	lifecycle := NewLifecycle(nil)
+	container := NextflowContainer{ContainerID: "id", DieTime: time.Unix(100, 0)}
+	lifecycle.Transition(StateStarted, container)
+	lifecycle.Transition(StateDied, container)
+	lifecycle.Finish(container)
+
+	if _, err := lifecycle.Transition(StateDied, container); err == nil {
+		t.Error("the die of a processed container was accepted again")
+	}
+
+	// A later run of the same container is still processed.
+	container.DieTime = time.Unix(200, 0)
+	if _, err := lifecycle.Transition(StateDied, container); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLifecycleRejectsProcessedDieAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := NextflowContainer{ContainerID: "id", DieTime: time.Unix(100, 0)}
+	lifecycle := NewLifecycle(store)
+	lifecycle.Transition(StateStarted, container)
+	lifecycle.Transition(StateDied, container)
+	lifecycle.Finish(container)
+	store.Close()
+
+	store, err = OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	lifecycle = NewLifecycle(store)
+	if _, err := lifecycle.Transition(StateDied, container); !errors.Is(err, ErrProcessed) {
+		t.Errorf("got error %v, want ErrProcessed", err)
+	}
+}
+
+func TestContainerQueuesKeepOrder(t *testing.T) {
+	var wg sync.WaitGroup
+	queues := newContainerQueues(&wg)
+
+	var mu sync.Mutex
+	order := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for _, id := range []string{"a", "b", "c"} {
+			queues.Run(id, func() {
+				if i%10 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				mu.Lock()
+				order[id] = append(order[id], i)
+				mu.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+
+	for id, handled := range order {
+		if len(handled) != 100 {
+			t.Fatalf("container %s: handled %d events, want 100", id, len(handled))
+		}
+		for i, n := range handled {
+			if n != i {
+				t.Fatalf("container %s: event %d handled at position %d", id, n, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MA-DOS/LowLevelMonitoring/aggregate"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+)
+
+// Version of the started/died CSV columns. Bump it whenever the columns change
+// so downstream notebooks can tell files apart.
+const LifecycleSchemaVersion = "3"
+
+// MetadataOptions selects which Docker labels and environment variables are
+// recorded for each task.
+type MetadataOptions struct {
+	Labels []string
+	Env    []string
+}
+
+// WatchOptions configure the local container watcher.
+type WatchOptions struct {
+	Metadata MetadataOptions
+	WorkerIP string // Stamped on every container seen by this watcher.
+}
+
+// workerHostname is the hostname of the node the watcher runs on.
+var workerHostname = sync.OnceValue(func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Warn("Error reading hostname: ", err)
+	}
+	return hostname
+})
+
+// addMetadata fills the image, command and selected labels and env vars.
+func addMetadata(ctx context.Context, c *NextflowContainer, apiClient *client.Client, containerInfo types.ContainerJSON, opts WatchOptions) {
+	c.WorkerIP = opts.WorkerIP
+	c.Hostname = workerHostname()
+	c.ImageID = containerInfo.Image
+	c.ImageDigest = resolveImageDigest(ctx, apiClient, containerInfo.Image)
+	if containerInfo.Config == nil {
+		return
+	}
+	c.Image = containerInfo.Config.Image
+	c.Entrypoint = containerInfo.Config.Entrypoint
+	c.Cmd = containerInfo.Config.Cmd
+	c.ContainerHostname = containerInfo.Config.Hostname
+
+	if len(opts.Metadata.Labels) > 0 {
+		c.Labels = make(map[string]string)
+		for _, label := range opts.Metadata.Labels {
+			if value, ok := containerInfo.Config.Labels[label]; ok {
+				c.Labels[label] = value
+			}
+		}
+	}
+	if len(opts.Metadata.Env) > 0 {
+		c.Env = make(map[string]string)
+		for _, variable := range containerInfo.Config.Env {
+			key, value, _ := strings.Cut(variable, "=")
+			for _, allowed := range opts.Metadata.Env {
+				if key == allowed {
+					c.Env[key] = value
+				}
+			}
+		}
+	}
+}
+
+// resolveImageDigest returns the repo digest of the image, falling back to the
+// local image ID for images that were never pushed or pulled.
+func resolveImageDigest(ctx context.Context, apiClient *client.Client, imageID string) string {
+	if apiClient == nil || imageID == "" {
+		return imageID
+	}
+	image, err := apiClient.ImageInspect(ctx, imageID)
+	if err != nil {
+		logrus.Warnf("Error inspecting image %s: %v", imageID, err)
+		return imageID
+	}
+	if len(image.RepoDigests) > 0 {
+		return image.RepoDigests[0]
+	}
+	return image.ID
+}
+
+func metadataHeader(opts MetadataOptions) []string {
+	header := []string{"Image", "ImageDigest", "Entrypoint", "Cmd", "Hostname", "WorkerIP", "ContainerHostname"}
+	for _, label := range opts.Labels {
+		header = append(header, "label:"+label)
+	}
+	for _, variable := range opts.Env {
+		header = append(header, "env:"+variable)
+	}
+	return header
+}
+
+func metadataRecord(c NextflowContainer, opts MetadataOptions) []string {
+	record := []string{
+		c.Image,
+		c.ImageDigest,
+		strings.Join(c.Entrypoint, " "),
+		strings.Join(c.Cmd, " "),
+		c.Hostname,
+		c.WorkerIP,
+		c.ContainerHostname,
+	}
+	for _, label := range opts.Labels {
+		record = append(record, c.Labels[label])
+	}
+	for _, variable := range opts.Env {
+		record = append(record, c.Env[variable])
+	}
+	return record
+}
+
+func formatTime(t time.Time) string {
+	return aggregate.FormatTime(t)
+}
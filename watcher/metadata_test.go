@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestAddMetadataKeepsSelectedLabelsAndEnv(t *testing.T) {
+	info := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{Image: "sha256:abc"},
+		Config: &container.Config{
+			Image:      "nextflow/task:1.0",
+			Entrypoint: []string{"/bin/bash"},
+			Cmd:        []string{"-c", ".command.sh"},
+			Hostname:   "task-host",
+			Labels:     map[string]string{"nextflow.io/task": "align", "other": "x"},
+			Env:        []string{"NXF_TASK_WORKDIR=/work/ab/cd", "SECRET=token", "EMPTY="},
+		},
+	}
+	opts := WatchOptions{
+		Metadata: MetadataOptions{Labels: []string{"nextflow.io/task", "missing"}, Env: []string{"NXF_TASK_WORKDIR", "EMPTY"}},
+		WorkerIP: "10.0.0.1",
+	}
+
+	var c NextflowContainer
+	addMetadata(context.Background(), &c, nil, info, opts)
+
+	if c.Image != "nextflow/task:1.0" || c.ImageDigest != "sha256:abc" || c.WorkerIP != "10.0.0.1" || c.ContainerHostname != "task-host" {
+		t.Errorf("got container %+v, want the image, digest, worker and hostname set", c)
+	}
+	if want := map[string]string{"nextflow.io/task": "align"}; !reflect.DeepEqual(c.Labels, want) {
+		t.Errorf("got labels %v, want %v", c.Labels, want)
+	}
+	if want := map[string]string{"NXF_TASK_WORKDIR": "/work/ab/cd", "EMPTY": ""}; !reflect.DeepEqual(c.Env, want) {
+		t.Errorf("got env %v, want %v", c.Env, want)
+	}
+
+	header, record := metadataHeader(opts.Metadata), metadataRecord(c, opts.Metadata)
+	if len(header) != len(record) {
+		t.Fatalf("got %d columns for a %d column header", len(record), len(header))
+	}
+	want := map[string]string{
+		"Cmd":                    "-c .command.sh",
+		"label:nextflow.io/task": "align",
+		"label:missing":          "",
+		"env:NXF_TASK_WORKDIR":   "/work/ab/cd",
+	}
+	for i, column := range header {
+		if value, ok := want[column]; ok && record[i] != value {
+			t.Errorf("column %s: got %q, want %q", column, record[i], value)
+		}
+	}
+}
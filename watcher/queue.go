@@ -0,0 +1,49 @@
+package watcher
+
+import "sync"
+
+// containerQueues runs the handlers of one container's events in the order
+// the events arrived, while events of different containers are handled
+// concurrently. A container's goroutine exits once its queue is empty.
+type containerQueues struct {
+	mu     sync.Mutex
+	queues map[string][]func()
+	wg     *sync.WaitGroup
+}
+
+func newContainerQueues(wg *sync.WaitGroup) *containerQueues {
+	return &containerQueues{
+		queues: make(map[string][]func()),
+		wg:     wg,
+	}
+}
+
+// Run queues the handler behind the pending handlers of the container.
+func (q *containerQueues) Run(containerID string, handler func()) {
+	q.mu.Lock()
+	pending, running := q.queues[containerID]
+	q.queues[containerID] = append(pending, handler)
+	q.mu.Unlock()
+	if running {
+		return
+	}
+	q.wg.Add(1)
+	go q.drain(containerID)
+}
+
+func (q *containerQueues) drain(containerID string) {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		pending := q.queues[containerID]
+		if len(pending) == 0 {
+			delete(q.queues, containerID)
+			q.mu.Unlock()
+			return
+		}
+		handler := pending[0]
+		q.queues[containerID] = pending[1:]
+		q.mu.Unlock()
+		handler()
+	}
+}
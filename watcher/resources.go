@@ -0,0 +1,67 @@
+package watcher
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// ResourceLimits are the CPU and memory limits Docker enforced on a container.
+// Zero values mean unlimited.
+type ResourceLimits struct {
+	NanoCPUs   int64  `json:"nano_cpus,omitempty"`
+	CPUQuota   int64  `json:"cpu_quota,omitempty"`
+	CPUPeriod  int64  `json:"cpu_period,omitempty"`
+	CpusetCpus string `json:"cpuset_cpus,omitempty"`
+	Memory     int64  `json:"memory,omitempty"`
+}
+
+func newResourceLimits(hostConfig *container.HostConfig) ResourceLimits {
+	if hostConfig == nil {
+		return ResourceLimits{}
+	}
+	return ResourceLimits{
+		NanoCPUs:   hostConfig.NanoCPUs,
+		CPUQuota:   hostConfig.CPUQuota,
+		CPUPeriod:  hostConfig.CPUPeriod,
+		CpusetCpus: hostConfig.CpusetCpus,
+		Memory:     hostConfig.Memory,
+	}
+}
+
+// AllocatedCPUs returns the number of cores the container was allowed to use,
+// preferring --cpus over the CFS quota over the cpuset. Zero means unlimited.
+func (r ResourceLimits) AllocatedCPUs() float64 {
+	switch {
+	case r.NanoCPUs > 0:
+		return float64(r.NanoCPUs) / 1e9
+	case r.CPUQuota > 0 && r.CPUPeriod > 0:
+		return float64(r.CPUQuota) / float64(r.CPUPeriod)
+	case r.CpusetCpus != "":
+		return float64(countCpuset(r.CpusetCpus))
+	}
+	return 0
+}
+
+// countCpuset counts the CPUs in a cpuset list such as "0-3,8,10-11".
+func countCpuset(cpuset string) int {
+	count := 0
+	for _, part := range strings.Split(cpuset, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		if high >= low {
+			count += high - low + 1
+		}
+	}
+	return count
+}
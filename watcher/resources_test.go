@@ -0,0 +1,29 @@
+package watcher
+
+import "testing"
+
+func TestAllocatedCPUs(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ResourceLimits
+		want   float64
+	}{
+		{"unlimited", ResourceLimits{}, 0},
+		{"nano cpus", ResourceLimits{NanoCPUs: 1500000000, CpusetCpus: "0-7"}, 1.5},
+		{"cfs quota", ResourceLimits{CPUQuota: 200000, CPUPeriod: 100000, CpusetCpus: "0-7"}, 2},
+		{"quota without period", ResourceLimits{CPUQuota: 200000, CpusetCpus: "0"}, 1},
+		{"single cpu", ResourceLimits{CpusetCpus: "3"}, 1},
+		{"range", ResourceLimits{CpusetCpus: "0-3"}, 4},
+		{"list", ResourceLimits{CpusetCpus: "0-3,8,10-11"}, 7},
+		{"spaces", ResourceLimits{CpusetCpus: "0, 2-3"}, 3},
+		{"reversed range", ResourceLimits{CpusetCpus: "3-1,5"}, 1},
+		{"malformed", ResourceLimits{CpusetCpus: "a,1-b,2"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.limits.AllocatedCPUs(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
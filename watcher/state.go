@@ -0,0 +1,285 @@
+package watcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const stateFileName = "monitor_state.jsonl"
+
+const (
+	// The log is compacted once this many entries were appended since the
+	// last compaction and it holds at least twice as many lines as needed.
+	compactAfterEntries = 10000
+	// Appended entries are synced to disk in batches at this interval.
+	stateSyncInterval = 100 * time.Millisecond
+	// Number of processed containers kept through compaction, so a restarted
+	// controller still recognises a re-sent die event.
+	keepProcessed = recentCapacity
+)
+
+// StateEntry is a single line of the append-only state log.
+type StateEntry struct {
+	Time        time.Time         `json:"time"`
+	ContainerID string            `json:"container_id"`
+	State       LifecycleState    `json:"state"`
+	Container   NextflowContainer `json:"container"`
+}
+
+// StateStore records container lifecycle and processing status on disk so a
+// restarted controller knows which containers still have to be finished.
+type StateStore struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	entries  map[string]StateEntry // Latest entry per container ID.
+	recent   []StateEntry          // Latest processed entry per container ID, oldest first.
+	appended int                   // Entries appended since the last compaction.
+	dirty    bool                  // Entries appended since the last sync.
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// OpenStateStore opens (or creates) the state log in dir, replays it and
+// compacts it down to the containers that have not been processed yet and the
+// most recently processed ones.
+func OpenStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+	s := &StateStore{
+		path:    filepath.Join(dir, stateFileName),
+		entries: make(map[string]StateEntry),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+	go s.syncPeriodically()
+	logrus.Infof("Opened state store %s with %d unfinished containers", s.path, len(s.entries))
+	return s, nil
+}
+
+// reopen compacts the log and opens it for appending.
+func (s *StateStore) reopen() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := s.compact(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening state file: %w", err)
+	}
+	s.file = file
+	s.appended = 0
+	s.dirty = false
+	return nil
+}
+
+// syncPeriodically syncs appended entries in batches, so recording a state
+// change does not wait for the disk.
+func (s *StateStore) syncPeriodically() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(stateSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Sync(); err != nil {
+				logrus.Error("Error syncing state file: ", err)
+			}
+		}
+	}
+}
+
+// Sync writes the appended entries to disk.
+func (s *StateStore) Sync() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty || s.file == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.dirty = false
+	file := s.file
+	s.mu.Unlock()
+
+	// Syncing outside the lock lets appends continue meanwhile. A compaction
+	// closing the file in between has synced it already.
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// replay reads the log and keeps the latest entry per container.
+func (s *StateStore) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening state file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry StateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write at the end of the log is expected after a crash.
+			logrus.Warn("Skipping corrupt state entry: ", err)
+			continue
+		}
+		s.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (s *StateStore) apply(entry StateEntry) {
+	if entry.State == StateProcessed {
+		for i, recent := range s.recent {
+			if recent.ContainerID == entry.ContainerID {
+				s.recent = append(s.recent[:i], s.recent[i+1:]...)
+				break
+			}
+		}
+		s.recent = append(s.recent, entry)
+		if len(s.recent) > keepProcessed {
+			s.recent = s.recent[len(s.recent)-keepProcessed:]
+		}
+	}
+	if entry.State == StateProcessed || entry.State == StateEvicted {
+		delete(s.entries, entry.ContainerID)
+		return
+	}
+	s.entries[entry.ContainerID] = entry
+}
+
+// compact rewrites the log so it only holds the recently processed and the
+// unfinished containers. Processed entries go first as a container may have
+// restarted since.
+func (s *StateStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating state file: %w", err)
+	}
+	encoder := json.NewEncoder(tmp)
+	for _, entry := range s.recent {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing state file: %w", err)
+		}
+	}
+	for _, entry := range s.entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error writing state file: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// Record appends a state change for the container to the log. Entries reach
+// the disk with the next batched sync.
+func (s *StateStore) Record(state LifecycleState, container NextflowContainer) error {
+	if s == nil {
+		return nil
+	}
+	entry := StateEntry{
+		Time:        time.Now(),
+		ContainerID: container.ContainerID,
+		State:       state,
+		Container:   container,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("state store is closed")
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing state entry: %w", err)
+	}
+	s.apply(entry)
+	s.dirty = true
+	s.appended++
+	if s.appended >= compactAfterEntries && s.appended >= len(s.entries)+len(s.recent) {
+		if err := s.reopen(); err != nil {
+			return fmt.Errorf("error compacting state file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Entries returns the latest entry of every unfinished container.
+func (s *StateStore) Entries() []StateEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]StateEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Processed returns the latest entry of the most recently processed
+// containers, oldest first.
+func (s *StateStore) Processed() []StateEntry {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StateEntry(nil), s.recent...)
+}
+
+func (s *StateStore) Close() error {
+	if s == nil || s.file == nil {
+		return nil
+	}
+	close(s.done)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := errors.Join(s.file.Sync(), s.file.Close())
+	s.file = nil
+	return err
+}
@@ -0,0 +1,106 @@
+package watcher
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestStateStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Record(StateStarted, NextflowContainer{ContainerID: id, Name: "task-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Record(StateDied, NextflowContainer{ContainerID: "b"})
+	store.Record(StateProcessed, NextflowContainer{ContainerID: "c"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn write at the end of the log is skipped.
+	file, err := os.OpenFile(filepath.Join(dir, stateFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"container_id":"d","sta`)
+	file.Close()
+
+	store, err = OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	states := make(map[string]LifecycleState)
+	for _, entry := range store.Entries() {
+		states[entry.ContainerID] = entry.State
+	}
+	want := map[string]LifecycleState{"a": StateStarted, "b": StateDied}
+	if len(states) != len(want) {
+		t.Fatalf("got entries %v, want %v", states, want)
+	}
+	for id, state := range want {
+		if states[id] != state {
+			t.Errorf("container %s: got state %q, want %q", id, states[id], state)
+		}
+	}
+	if processed := store.Processed(); len(processed) != 1 || processed[0].ContainerID != "c" {
+		t.Errorf("got processed entries %v, want c", processed)
+	}
+	// Opening compacts the log to the unfinished and processed containers.
+	if lines := countLines(t, filepath.Join(dir, stateFileName)); lines != 3 {
+		t.Errorf("got %d lines after compaction, want 3", lines)
+	}
+}
+
+func TestStateStoreCompactsWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Record(StateStarted, NextflowContainer{ContainerID: "pending"})
+	for i := 0; i < compactAfterEntries+10; i++ {
+		container := NextflowContainer{ContainerID: "done"}
+		store.Record(StateStarted, container)
+		store.Record(StateProcessed, container)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := countLines(t, filepath.Join(dir, stateFileName)); lines > compactAfterEntries {
+		t.Errorf("log holds %d lines, want it compacted below %d", lines, compactAfterEntries)
+	}
+	store, err = OpenStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	entries := store.Entries()
+	if len(entries) != 1 || entries[0].ContainerID != "pending" {
+		t.Errorf("got entries %v, want only the pending container", entries)
+	}
+}